@@ -1,12 +1,10 @@
 package arrange
 
 import (
-	"crypto/md5"
+	"errors"
 	"fmt"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -15,22 +13,21 @@ import (
 	"time"
 )
 
-var exts map[string]bool
-
 func init() {
-	exts = map[string]bool{
-		// images
-		".jpg":  true,
-		".jpeg": true,
-		".png":  true,
-		".gif":  true,
+	// images
+	Register(jpegParser{})
+	Register(pngParser{})
+	Register(gifParser{})
+	Register(heifParser{})
 
-		// videos
-		".mov": true,
-		".mp4": true,
-		".m4v": true,
-		".avi": true,
+	// camera raw
+	for _, ext := range []string{".cr2", ".nef", ".arw", ".dng", ".orf", ".rw2"} {
+		Register(rawParser{ext})
 	}
+
+	// videos
+	Register(quickTimeParser{})
+	Register(aviParser{})
 }
 
 func mtime(path string) (time.Time, error) {
@@ -42,8 +39,41 @@ func mtime(path string) (time.Time, error) {
 	return s.ModTime(), nil
 }
 
-// PrepOutput creates all possible content-address prefix directories.
+// PrepOutput creates all possible content-address prefix directories, and
+// records HashAlgorithm, Links, DateTemplate and DateZone in a new tree's
+// Config. It fails if root already uses different ones.
 func PrepOutput(root string) error {
+	if _, err := newHash(HashAlgorithm); err != nil {
+		return err
+	}
+	if err := checkLinks(Links); err != nil {
+		return err
+	}
+	if err := checkTemplate(DateTemplate); err != nil {
+		return err
+	}
+	if _, err := loadZone(DateZone); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(root, configName)); os.IsNotExist(err) {
+		c := Config{Hash: "md5", Links: "hard", Template: DefaultTemplate, Zone: CaptureZone}
+		if _, err := os.Stat(filepath.Join(root, "content")); os.IsNotExist(err) {
+			c.Hash = HashAlgorithm
+			c.Links = Links
+			c.Template = DateTemplate
+			c.Zone = DateZone
+		}
+		if err := WriteConfig(root, c); err != nil {
+			return err
+		}
+	}
+	if err := CheckConfig(root); err != nil {
+		return err
+	}
+
 	for i := 0; i <= 0xff; i++ {
 		dirname := filepath.Join(root, "content", fmt.Sprintf("%02x", i))
 		if err := os.MkdirAll(dirname, 0755); err != nil {
@@ -56,21 +86,51 @@ func PrepOutput(root string) error {
 	return nil
 }
 
-// Source returns sends all files that match known extensions.
+// Source returns sends all files that match registered extensions, or every
+// file when Sniff is set. XMP sidecars are left to go with their media.
 func Source(root string) <-chan string {
 	out := make(chan string)
 	go func() {
 		err := filepath.Walk(
 			root,
 			func(path string, info os.FileInfo, err error) error {
+				// in move mode, a sidecar can be taken along with its
+				// media before the walk reaches it
+				if os.IsNotExist(err) {
+					return nil
+				}
 				if err != nil {
 					return err
 				}
-				if info.IsDir() {
+				if info.IsDir() || isSidecar(path) {
 					return nil
 				}
 				ext := strings.ToLower(filepath.Ext(path))
-				if _, ok := exts[ext]; ok {
+				if lookup(ext) != nil || Sniff {
+					out <- path
+				}
+				return nil
+			},
+		)
+		if err != nil {
+			log.Printf("problem during crawl: %+v", err)
+		}
+		close(out)
+	}()
+	return out
+}
+
+// Blobs sends the paths of all files in the content store under root.
+func Blobs(root string) <-chan string {
+	out := make(chan string)
+	go func() {
+		err := filepath.Walk(
+			filepath.Join(root, "content"),
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), tempPrefix) {
 					out <- path
 				}
 				return nil
@@ -84,26 +144,120 @@ func Source(root string) <-chan string {
 	return out
 }
 
+// staleAge is how long a temporary file goes untouched before Sweep assumes
+// that the run which made it is gone.
+const staleAge = time.Hour
+
+// Sweep removes temporary files left in root's content and date trees by
+// interrupted runs, and returns how many it removed. Recently modified ones
+// are left alone, in case another run is still using them.
+func Sweep(root string) (int, error) {
+	n := 0
+	for _, tree := range []string{"content", "date"} {
+		err := filepath.Walk(
+			filepath.Join(root, tree),
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				swept, err := sweepFile(path, info)
+				if swept {
+					n++
+				}
+				return err
+			},
+		)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// sweepDir removes stale temporary files from dir, but not from below it, as
+// Undo leaves them beside the originals it puts back.
+func sweepDir(dir string) (int, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fi := range fis {
+		swept, err := sweepFile(filepath.Join(dir, fi.Name()), fi)
+		if err != nil {
+			return n, err
+		}
+		if swept {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// sweepFile removes the file at path if it is a stale temporary file, and
+// reports whether it did.
+func sweepFile(path string, info os.FileInfo) (bool, error) {
+	if info.IsDir() || !strings.HasPrefix(info.Name(), tempPrefix) {
+		return false, nil
+	}
+	if time.Since(info.ModTime()) < staleAge {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // Parse runs the file parser for each file on input chan, and sends results
-// down output chan.
+// down output chan. Files that can't be parsed are logged and skipped; see
+// ParseReport to record them instead.
 //
 // Exists so that it can be called many times concurrently.
 func Parse(in <-chan string) <-chan Media {
+	return ParseReport(in, logFailure)
+}
+
+// ParseReport is Parse, but hands each file that can't be parsed to report,
+// as a Result with Err set to NotMedia or whatever else went wrong, rather
+// than logging it. report is called from the goroutine that sends on the
+// output chan, so it must not wait on that chan being drained.
+func ParseReport(in <-chan string, report func(Result)) <-chan Media {
+	return parseAll(in, ParseFile, report)
+}
+
+// Stage runs StageFile for each file on input chan, and sends results down
+// output chan as Parse does.
+//
+// Exists so that it can be called many times concurrently.
+func Stage(in <-chan string, root string) <-chan Media {
+	return StageReport(in, root, logFailure)
+}
+
+// StageReport is Stage, but hands files that can't be parsed to report as
+// ParseReport does.
+func StageReport(in <-chan string, root string, report func(Result)) <-chan Media {
+	return parseAll(in, func(path string) (Media, error) {
+		return StageFile(path, root)
+	}, report)
+}
+
+func parseAll(in <-chan string, parse func(string) (Media, error), report func(Result)) <-chan Media {
 	out := make(chan Media)
 	go func() {
 		for path := range in {
-			f, err := ParseFile(path)
+			f, err := parse(path)
 			if err != nil {
-				switch err.(type) {
-				case NotMedia:
-					log.Printf("%+v", err)
-				default:
-					log.Printf("parse error: %+v", err)
-				}
+				report(Result{Media: Media{Path: path}, Err: err})
 				continue
-			} else {
-				out <- f
 			}
+			if f.Misnamed != "" {
+				log.Printf("%q is named %s but is really %s", f.Path, f.Misnamed, f.Extension)
+			}
+			if f.Skew != 0 {
+				log.Printf("%q: corrected clock by %v", f.Path, f.Skew)
+			}
+			out <- f
 		}
 		close(out)
 	}()
@@ -111,22 +265,43 @@ func Parse(in <-chan string) <-chan Media {
 	return out
 }
 
+// logFailure logs the Result for a file that couldn't be parsed.
+func logFailure(r Result) {
+	switch r.Err.(type) {
+	case NotMedia:
+		log.Printf("%+v", r.Err)
+	default:
+		log.Printf("parse error: %+v", r.Err)
+	}
+}
+
 // MissingLink detects if the values coming from medias is a duplicate file
-// rather than a hardlink to the content store.
+// rather than a link to the content store of the kind Links asks for. Such
+// Media can be fixed with Relink; if Links differs from what root's Config
+// records, that converts the tree.
+//
+// Nothing is sent on the Media chan if root is addressed with a hash other
+// than HashAlgorithm.
 func MissingLink(medias <-chan Media, root string) (<-chan Media, <-chan error) {
 	out := make(chan Media)
 	errs := make(chan error)
 	go func() {
-		for m := range medias {
-			var d, c os.FileInfo
-			var err error
-			if d, err = os.Stat(m.Path); err != nil {
-				errs <- err
+		c, err := ReadConfig(root)
+		if err == nil && c.Hash != HashAlgorithm {
+			err = fmt.Errorf("%q is addressed with %s, not %s", root, c.Hash, HashAlgorithm)
+		}
+		if err != nil {
+			errs <- err
+			for range medias {
 			}
-			if c, err = os.Stat(m.Content(root)); err != nil {
+		}
+		for m := range medias {
+			ok, err := linked(m.Path, m.Content(root))
+			if err != nil {
 				errs <- err
+				continue
 			}
-			if !os.SameFile(d, c) {
+			if !ok {
 				out <- m
 			}
 		}
@@ -149,12 +324,78 @@ func Move(in <-chan Media, root string) <-chan error {
 	return out
 }
 
+// Take calls Take on each Media on input chan. It can be used in place of
+// Move.
+func Take(in <-chan Media, root string) <-chan error {
+	out := make(chan error)
+	go func() {
+		for i := range in {
+			out <- i.Take(root)
+		}
+		close(out)
+	}()
+	return out
+}
+
+// Place calls Place on each Media on input chan, and sends the results down
+// output chan. It can be used in place of Move or Take.
+func Place(in <-chan Media, root string, take bool) <-chan Result {
+	out := make(chan Result)
+	go func() {
+		for i := range in {
+			out <- i.Place(root, take)
+		}
+		close(out)
+	}()
+	return out
+}
+
 // ParseFile extracts metadata from single file.
 func ParseFile(path string) (Media, error) {
+	return parseFile(path, nil)
+}
+
+// StageFile is like ParseFile, but also copies the file into a temporary file
+// in root's content store as it is read, so that Move need not read it again.
+// The copy of a file whose content is already in the store is thrown away
+// unsynced, as Move has nothing to do with it.
+func StageFile(path, root string) (Media, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(root, "content"), tempPrefix)
+	if err != nil {
+		return Media{}, fmt.Errorf("could not create staging file: %v", err)
+	}
+	m, err := parseFile(path, tmp)
+	if err == nil && exists(m.Content(root)) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return m, nil
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("problem staging %q: %v", path, cerr)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return m, err
+	}
+	m.staged = tmp.Name()
+	return m, nil
+}
+
+// parseFile reads the file at path exactly once, sending every byte through
+// the hash (and to w, if not nil) while the Parser inspects it.
+func parseFile(path string, w io.Writer) (Media, error) {
 	ext := strings.ToLower(filepath.Ext(path))
 	var r Media
-	hash := md5.New()
-	var t time.Time
+	hash, err := newHash(HashAlgorithm)
+	if err != nil {
+		return r, err
+	}
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -162,72 +403,93 @@ func ParseFile(path string) (Media, error) {
 	}
 	defer f.Close()
 
-	switch ext {
-	default:
-		return r, NotMedia{path}
-	case ".jpg", ".jpeg":
-		if _, err := jpeg.DecodeConfig(f); err != nil {
-			return r, NotMedia{path}
-		}
-		if _, err := f.Seek(0, 0); err != nil {
-			return r, fmt.Errorf("couldn't seek back in file: %v", err)
-		}
+	sink := io.Writer(hash)
+	if w != nil {
+		sink = io.MultiWriter(hash, w)
+	}
+	hr := &hashReader{f: f, w: sink}
 
-		// try a few things for a time value
-		{
-			success := false
-			if t, err = parseExif(f); err == nil {
-				success = true
-			}
-			if !success {
-				t, err = mtime(path)
-			}
-			if err != nil {
-				return r, fmt.Errorf("unable to calculate reasonble time for jpg %q: %v", path, err)
-			}
-		}
-	case ".png":
-		if _, err := png.DecodeConfig(f); err != nil {
-			return r, NotMedia{path}
+	p := lookup(ext)
+	misnamed := ""
+	if Sniff {
+		hdr, err := header(hr)
+		if err != nil {
+			return r, fmt.Errorf("problem sniffing file type: %v", err)
 		}
-		if _, err := f.Seek(0, 0); err != nil {
-			return r, fmt.Errorf("couldn't seek back in file: %v", err)
+		// trust the name if its format agrees with the contents
+		if p == nil || !p.Sniff(hdr) {
+			if q := detect(hdr); q != nil {
+				p = q
+				if c := canonical(q, hdr); c != ext {
+					misnamed, ext = ext, c
+				}
+			}
 		}
+	}
+	if p == nil {
+		return r, NotMedia{path}
+	}
 
-		t, err = mtime(path)
-		if err != nil {
-			return r, fmt.Errorf("unable to calculate reasonble time for media %q: %v", path, err)
+	// try a few things for a time value
+	var c capture
+	var sidecar string
+	{
+		success := false
+		if cp, ok := p.(capturer); ok {
+			c, err = cp.captured(hr)
+		} else {
+			c.source = TimeContainer
+			c.time, err = p.Time(hr)
 		}
-	case ".gif":
-		if _, err := gif.DecodeConfig(f); err != nil {
+		sidecar = findSidecar(path)
+		c, err = withXMP(c, err, readSidecar(sidecar))
+		switch {
+		case err == ErrFormat:
 			return r, NotMedia{path}
+		case err == nil && !c.time.IsZero() && rank(c.source) >= 0:
+			success = true
 		}
-		if _, err := f.Seek(0, 0); err != nil {
-			return r, fmt.Errorf("couldn't seek back in file: %v", err)
+		if success {
+			t := c.time
+			c.time = correct(c.camera, t)
+			c.skew = c.time.Sub(t)
 		}
-
-		t, err = mtime(path)
-		if err != nil {
-			return r, fmt.Errorf("unable to calculate reasonble time for media %q: %v", path, err)
+		if n := rank(TimeFilename); n >= 0 && (!success || n < rank(c.source)) {
+			if t, ok := nameTime(path); ok {
+				c = capture{time: t, source: TimeFilename, zone: ZoneLocal}
+				success = true
+			}
 		}
-	case ".mov", ".mp4", ".m4v", ".avi":
-		t, err = mtime(path)
-		if err != nil {
-			return r, fmt.Errorf("unable to calculate reasonble time for media %q: %v", path, err)
+		if m := rank(TimeMtime); m >= 0 && (!success || m < rank(c.source)) {
+			c = capture{source: TimeMtime}
+			c.time, err = mtime(path)
+			if err != nil {
+				return r, fmt.Errorf("unable to calculate reasonble time for media %q: %v", path, err)
+			}
+			success = true
+		}
+		if !success {
+			if err == nil {
+				err = errors.New("no time")
+			}
+			return r, fmt.Errorf("unable to calculate reasonble time for media %q from %v: %v", path, TimePrecedence, err)
 		}
 	}
 
-	if _, err := f.Seek(0, 0); err != nil {
-		return r, fmt.Errorf("couldn't seek back in file: %v", err)
-	}
-	if _, err := io.Copy(hash, f); err != nil {
+	if err := hr.finish(); err != nil {
 		return r, fmt.Errorf("problem calculating checksum on %q: %v", path, err)
 	}
 	r = Media{
-		Path:      path,
-		Hash:      fmt.Sprintf("%x", hash.Sum(nil)),
-		Extension: ext,
-		Time:      t,
+		Path:       path,
+		Hash:       fmt.Sprintf("%x", hash.Sum(nil)),
+		Extension:  ext,
+		Time:       c.time,
+		TimeSource: c.source,
+		Zone:       c.zone,
+		Skew:       c.skew,
+		Rating:     c.rating,
+		Sidecar:    sidecar,
+		Misnamed:   misnamed,
 	}
 	return r, nil
 }
@@ -1,10 +1,15 @@
 package arrange
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -129,6 +134,18 @@ func TestBadFiles(t *testing.T) {
 		{
 			path: filepath.Join(wd, "testdata", "too-many-links.jpg"),
 		},
+		{
+			path: filepath.Join(wd, "testdata", "not.an.avi"),
+		},
+		{
+			path: filepath.Join(wd, "testdata", "not.a.heic"),
+		},
+		{
+			path: filepath.Join(wd, "testdata", "not.a.cr2"),
+		},
+		{
+			path: filepath.Join(wd, "testdata", "not.a.nef"),
+		},
 	}
 	for _, test := range tests {
 		_, err := _parse(test.path)
@@ -196,6 +213,7 @@ func TestMoveCollision(t *testing.T) {
 func TestSundry(t *testing.T) {
 	_ = fmt.Sprintf("%v", NotMedia{"hi"})
 	_ = fmt.Sprintf("%v", Dup{"hi"})
+	_ = fmt.Sprintf("%v", Collision{"hi", "there"})
 }
 
 func TestFlow(t *testing.T) {
@@ -297,3 +315,2555 @@ func TestFlow(t *testing.T) {
 		}
 	}
 }
+
+func TestQuickTime(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mt := time.Date(2012, 10, 21, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		path     string
+		expected time.Time
+	}{
+		{
+			path:     filepath.Join(wd, "testdata", "a.mp4"),
+			expected: time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			path:     filepath.Join(wd, "testdata", "b.m4v"),
+			expected: time.Date(2014, 2, 3, 4, 5, 6, 0, time.UTC),
+		},
+		{
+			path:     filepath.Join(wd, "testdata", "creationdate.mov"),
+			expected: time.Date(2016, 8, 20, 15, 15, 0, 0, time.UTC),
+		},
+		{
+			// not a real container; falls back to mtime
+			path:     filepath.Join(wd, "testdata", "a.mov"),
+			expected: mt,
+		},
+	}
+	for _, test := range tests {
+		if err := os.Chtimes(test.path, mt, mt); err != nil {
+			t.Fatalf("chtime fail: %v", err)
+		}
+		m, err := ParseFile(test.path)
+		if err != nil {
+			t.Fatalf("problem parsing %q: %v", test.path, err)
+		}
+		if !m.Time.Equal(test.expected) {
+			t.Errorf("%q: got %v, want %v", test.path, m.Time, test.expected)
+		}
+	}
+}
+
+func TestAVI(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		expected time.Time
+	}{
+		{
+			path:     filepath.Join(wd, "testdata", "idit.avi"),
+			expected: time.Date(2010, 10, 7, 14, 30, 0, 0, time.Local),
+		},
+		{
+			path:     filepath.Join(wd, "testdata", "strd.avi"),
+			expected: time.Date(2007, 5, 12, 8, 9, 10, 0, time.Local),
+		},
+	}
+	for _, test := range tests {
+		m, err := ParseFile(test.path)
+		if err != nil {
+			t.Fatalf("problem parsing %q: %v", test.path, err)
+		}
+		if !m.Time.Equal(test.expected) {
+			t.Errorf("%q: got %v, want %v", test.path, m.Time, test.expected)
+		}
+	}
+
+	if _, err := ParseFile(filepath.Join(wd, "testdata", "not.an.avi")); err == nil {
+		t.Fatal("expected error parsing non-avi riff file")
+	} else if _, ok := err.(NotMedia); !ok {
+		t.Fatalf("expected NotMedia, got %T: %v", err, err)
+	}
+}
+
+func TestHEIF(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ParseFile(filepath.Join(wd, "testdata", "exif.heic"))
+	if err != nil {
+		t.Fatalf("problem parsing heic: %v", err)
+	}
+	expected := time.Date(2018, 12, 25, 7, 30, 0, 0, time.Local)
+	if !m.Time.Equal(expected) {
+		t.Errorf("got %v, want %v", m.Time, expected)
+	}
+	if err := m.Move(tmp); err != nil {
+		t.Fatalf("problem moving file into place: %v", err)
+	}
+	p := fmt.Sprintf("date/2018/12/%d.heic", expected.UnixNano())
+	if _, err := os.Stat(filepath.Join(tmp, p)); os.IsNotExist(err) {
+		t.Errorf("could not find expected file %q: %v", p, err)
+	}
+}
+
+func TestIloc(t *testing.T) {
+	file := bytes.NewReader(make([]byte, 200))
+	tests := []struct {
+		off, length uint64
+		ok          bool
+	}{
+		{off: 100, length: 50, ok: true},
+		{off: 100, length: 100, ok: true},
+		{off: 100, length: 101},
+		{off: 201, length: 0},
+		{off: 100, length: 0xfffffffffffffff0},
+		{off: 0xfffffffffffffff0, length: 0x20},
+		{off: 1 << 63, length: 1},
+	}
+	for _, test := range tests {
+		iloc := []byte{
+			0, 0, 0, 0, // version, flags
+			0x88, 0x00, // offset and length sizes
+			0, 1, // item count
+			0, 1, // item id
+			0, 0, // data reference index
+			0, 1, // extent count
+		}
+		iloc = append(iloc, make([]byte, 16)...)
+		binary.BigEndian.PutUint64(iloc[14:], test.off)
+		binary.BigEndian.PutUint64(iloc[22:], test.length)
+		buf, err := ilocItem(file, box{}, iloc, 1)
+		if test.ok {
+			if err != nil {
+				t.Errorf("%d+%d: unexpected error: %v", test.off, test.length, err)
+			} else if uint64(len(buf)) != test.length {
+				t.Errorf("%d+%d: got %d bytes", test.off, test.length, len(buf))
+			}
+		} else if err == nil {
+			t.Errorf("%d+%d: expected an error", test.off, test.length)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		expected time.Time
+	}{
+		{
+			path:     filepath.Join(wd, "testdata", "exif.cr2"),
+			expected: time.Date(2017, 3, 4, 5, 6, 7, 0, time.Local),
+		},
+		{
+			path:     filepath.Join(wd, "testdata", "exif.nef"),
+			expected: time.Date(2017, 3, 5, 5, 6, 7, 0, time.Local),
+		},
+		{
+			path:     filepath.Join(wd, "testdata", "exif.orf"),
+			expected: time.Date(2017, 3, 6, 5, 6, 7, 0, time.Local),
+		},
+		{
+			path:     filepath.Join(wd, "testdata", "exif.rw2"),
+			expected: time.Date(2017, 3, 7, 5, 6, 7, 0, time.Local),
+		},
+	}
+	for _, test := range tests {
+		m, err := ParseFile(test.path)
+		if err != nil {
+			t.Fatalf("problem parsing %q: %v", test.path, err)
+		}
+		if !m.Time.Equal(test.expected) {
+			t.Errorf("%q: got %v, want %v", test.path, m.Time, test.expected)
+		}
+	}
+
+	// the image data after the EXIF is not read into memory
+	b, err := ioutil.ReadFile(tests[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lr := &io.LimitedReader{R: io.MultiReader(bytes.NewReader(b), zeros{}), N: 64 << 20}
+	c, err := parseRaw(lr, ".cr2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.time.Equal(tests[0].expected) {
+		t.Errorf("got %v, want %v", c.time, tests[0].expected)
+	}
+	if read := 64<<20 - lr.N; read > rawExifLimit {
+		t.Errorf("read %d bytes of a large raw file", read)
+	}
+
+	// but it is still hashed
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	big := filepath.Join(tmp, "big.cr2")
+	if err := ioutil.WriteFile(big, append(b, make([]byte, 2*rawExifLimit)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseFile(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := HashFile(big); err != nil || m.Hash != sum {
+		t.Errorf("got hash %q, want %q: %v", m.Hash, sum, err)
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestSourceVanished(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	for _, name := range []string{"a.cr2", "a.jpg", "a.xmp", "b.jpg"} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// taking a.cr2 in move mode takes its sidecar along before the walk
+	// gets to it, which can't be before a.jpg is received
+	work := Source(tmp)
+	if p := <-work; p != filepath.Join(tmp, "a.cr2") {
+		t.Fatalf("got %q first", p)
+	}
+	if err := os.Remove(filepath.Join(tmp, "a.xmp")); err != nil {
+		t.Fatal(err)
+	}
+	found := []string{}
+	for p := range work {
+		found = append(found, p)
+	}
+	if len(found) != 2 || found[1] != filepath.Join(tmp, "b.jpg") {
+		t.Errorf("crawl didn't go on past a vanished file: %v", found)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	Sniff = true
+	defer func() {
+		Sniff = false
+	}()
+
+	tests := []struct {
+		src      string
+		name     string
+		ext      string
+		misnamed string
+	}{
+		{src: "lenna.png", name: "lenna.jpg", ext: ".png", misnamed: ".jpg"},
+		{src: "valid.jpg", name: "IMG_0001", ext: ".jpg"},
+		{src: "valid.jpg", name: "photo.JPG.bak", ext: ".jpg", misnamed: ".bak"},
+		{src: "valid.jpg", name: "photo.jpeg", ext: ".jpeg"},
+		{src: "a.mp4", name: "a.mov", ext: ".mov"},
+		{src: "creationdate.mov", name: "VID_0001", ext: ".mov"},
+		{src: "exif.heic", name: "IMG_0002", ext: ".heic"},
+		{src: "idit.avi", name: "clip.mpg", ext: ".avi", misnamed: ".mpg"},
+		{src: "exif.cr2", name: "IMG_0003.nef", ext: ".cr2", misnamed: ".nef"},
+		{src: "exif.nef", name: "DSC_0001.nef", ext: ".nef"},
+	}
+	for _, test := range tests {
+		b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", test.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(tmp, test.name)
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ParseFile(p)
+		if err != nil {
+			t.Fatalf("problem parsing %q: %v", test.name, err)
+		}
+		if m.Extension != test.ext {
+			t.Errorf("%q: got extension %q, want %q", test.name, m.Extension, test.ext)
+		}
+		if m.Misnamed != test.misnamed {
+			t.Errorf("%q: got misnamed %q, want %q", test.name, m.Misnamed, test.misnamed)
+		}
+	}
+
+	for _, name := range []string{"not.a.jpg", "not.a.nef", "attribution.md"} {
+		if _, err := ParseFile(filepath.Join(wd, "testdata", name)); err == nil {
+			t.Errorf("%q: expected error, got nil", name)
+		}
+	}
+}
+
+type telemetryParser struct{}
+
+func (telemetryParser) Extensions() []string { return []string{".tlm"} }
+
+func (telemetryParser) Sniff(hdr []byte) bool { return bytes.HasPrefix(hdr, []byte("TLM1")) }
+
+func (telemetryParser) Time(r io.ReadSeeker) (time.Time, error) {
+	b := make([]byte, 4+len("2006-01-02T15:04:05Z"))
+	if _, err := io.ReadFull(r, b); err != nil || !bytes.HasPrefix(b, []byte("TLM1")) {
+		return time.Time{}, ErrFormat
+	}
+	return time.Parse(time.RFC3339, string(b[4:]))
+}
+
+func TestRegister(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+
+	Register(telemetryParser{})
+	defer unregister(telemetryParser{})
+
+	good := filepath.Join(tmp, "flight.tlm")
+	if err := ioutil.WriteFile(good, []byte("TLM12019-07-04T15:30:12Z and then some"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(tmp, "bad.tlm")
+	if err := ioutil.WriteFile(bad, []byte("nope"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bool{}
+	for p := range Source(tmp) {
+		found[p] = true
+	}
+	if !found[good] || !found[bad] {
+		t.Fatalf("source didn't find registered extension: %v", found)
+	}
+
+	m, err := ParseFile(good)
+	if err != nil {
+		t.Fatalf("problem parsing registered format: %v", err)
+	}
+	expected := time.Date(2019, 7, 4, 15, 30, 12, 0, time.UTC)
+	if !m.Time.Equal(expected) {
+		t.Errorf("got %v, want %v", m.Time, expected)
+	}
+	if _, err := ParseFile(bad); err == nil {
+		t.Error("expected error parsing bad file")
+	} else if _, ok := err.(NotMedia); !ok {
+		t.Errorf("expected NotMedia, got %T: %v", err, err)
+	}
+
+	Sniff = true
+	defer func() {
+		Sniff = false
+	}()
+	renamed := filepath.Join(tmp, "DJI_0001.mp4")
+	if err := os.Rename(good, renamed); err != nil {
+		t.Fatal(err)
+	}
+	m, err = ParseFile(renamed)
+	if err != nil {
+		t.Fatalf("problem parsing sniffed registered format: %v", err)
+	}
+	if m.Extension != ".tlm" || m.Misnamed != ".mp4" {
+		t.Errorf("got extension %q (misnamed %q), want .tlm (.mp4)", m.Extension, m.Misnamed)
+	}
+}
+
+func TestHashAlgorithm(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+		HashAlgorithm = "md5"
+	}()
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ParseFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Move(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	HashAlgorithm = "sha256"
+	if err := PrepOutput(tmp); err == nil {
+		t.Fatal("expected error preparing md5 tree for sha256")
+	}
+	for err := range Readdress(Blobs(tmp), tmp) {
+		if err != nil {
+			t.Fatalf("readdress: %v", err)
+		}
+	}
+	if err := WriteConfig(tmp, Config{Hash: "sha256"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = ParseFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Hash) != 64 {
+		t.Fatalf("got %d character hash, want 64", len(m.Hash))
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "content", "81", "4a0034f5549e957ee61360d87457e5.png")); !os.IsNotExist(err) {
+		t.Errorf("md5 address still present: %v", err)
+	}
+	if err := m.Move(tmp); err == nil {
+		t.Fatal("expected dup moving already readdressed file")
+	}
+
+	c, err := os.Stat(m.Content(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for p := range Source(filepath.Join(tmp, "date")) {
+		d, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(c, d) {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("got %d date links to readdressed blob, want 1", found)
+	}
+
+	// blake2b-256 sums are as long as sha256 ones, but still readdressed
+	sha := m.Content(tmp)
+	HashAlgorithm = "blake2b-256"
+	for err := range Readdress(Blobs(tmp), tmp) {
+		if err != nil {
+			t.Fatalf("readdress: %v", err)
+		}
+	}
+	m, err = ParseFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(m.Content(tmp)); err != nil {
+		t.Errorf("blake2b-256 address missing: %v", err)
+	}
+	if _, err := os.Stat(sha); !os.IsNotExist(err) {
+		t.Errorf("sha256 address still present: %v", err)
+	}
+	h, err := newHash("blake2b-256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("abc"))
+	if got, want := fmt.Sprintf("%x", h.Sum(nil)), "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"; got != want {
+		t.Errorf("blake2b-256 of abc: got %s, want %s", got, want)
+	}
+}
+
+func TestSinglePass(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	for p := range Source(filepath.Join(wd, "testdata")) {
+		m, err := ParseFile(p)
+		if err != nil {
+			continue
+		}
+		sum, err := HashFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Hash != sum {
+			t.Errorf("%q: parse hash %s, want %s", p, m.Hash, sum)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", "a.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(tmp, "a.mp4")
+	if err := ioutil.WriteFile(src, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := StageFile(src, tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Move mustn't need the original any more.
+	if err := os.Remove(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Move(tmp); err != nil {
+		t.Fatalf("problem moving staged file: %v", err)
+	}
+	got, err := ioutil.ReadFile(m.Content(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Error("staged content differs from original")
+	}
+	if err := m.Move(tmp); err == nil {
+		t.Error("expected dup moving staged file twice")
+	}
+
+	// content that is already stored isn't staged again
+	if err := ioutil.WriteFile(src, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err = StageFile(src, tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.staged != "" {
+		t.Errorf("duplicate staged at %q", m.staged)
+	}
+	left, err := filepath.Glob(filepath.Join(tmp, "content", tempPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("staging files left behind: %v", left)
+	}
+	if err := m.Move(tmp); err == nil {
+		t.Error("expected dup moving staged duplicate")
+	} else if _, ok := err.(Dup); !ok {
+		t.Errorf("expected Dup, got %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+
+	b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", "valid.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(tmp, "valid.jpg")
+	if err := ioutil.WriteFile(src, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	split := func(c *Cache) (hits, misses int) {
+		in := make(chan string, 1)
+		in <- src
+		close(in)
+		h, m := c.Split(in)
+		for h != nil || m != nil {
+			select {
+			case _, ok := <-h:
+				if !ok {
+					h = nil
+					continue
+				}
+				hits++
+			case p, ok := <-m:
+				if !ok {
+					m = nil
+					continue
+				}
+				misses++
+				for range c.Remember(Parse(singleton(p))) {
+				}
+			}
+		}
+		return hits, misses
+	}
+
+	c := NewCache(CachePath(tmp))
+	if h, m := split(c); h != 0 || m != 1 {
+		t.Fatalf("empty cache: got %d hits, %d misses", h, m)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = OpenCache(CachePath(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 1 {
+		t.Fatalf("reopened cache has %d entries, want 1", c.Len())
+	}
+	if h, m := split(c); h != 1 || m != 0 {
+		t.Fatalf("warm cache: got %d hits, %d misses", h, m)
+	}
+
+	// renaming it does too, as the name can date it
+	renamed := filepath.Join(tmp, "IMG_20190704_153012.jpg")
+	if err := os.Rename(src, renamed); err != nil {
+		t.Fatal(err)
+	}
+	src = renamed
+	if h, m := split(c); h != 0 || m != 1 {
+		t.Fatalf("renamed file: got %d hits, %d misses", h, m)
+	}
+	if h, m := split(c); h != 1 || m != 0 {
+		t.Fatalf("renamed file, again: got %d hits, %d misses", h, m)
+	}
+
+	// touching the file invalidates it
+	ts := time.Date(2012, 10, 21, 10, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(src, ts, ts); err != nil {
+		t.Fatal(err)
+	}
+	if h, m := split(c); h != 0 || m != 1 {
+		t.Fatalf("touched file: got %d hits, %d misses", h, m)
+	}
+
+	// and so does changing it and putting its mtime back; the sleep outlasts
+	// the coarse clock that ctimes are read from
+	time.Sleep(20 * time.Millisecond)
+	b[len(b)/2] ^= 0xff
+	if err := ioutil.WriteFile(src, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(src, ts, ts); err != nil {
+		t.Fatal(err)
+	}
+	if h, m := split(c); h != 0 || m != 1 {
+		t.Fatalf("file with mtime put back: got %d hits, %d misses", h, m)
+	}
+
+	// files whose content has left the store are forgotten
+	if before, n := c.Len(), c.Prune(tmp); n != before || c.Len() != 0 {
+		t.Fatalf("pruned %d of %d entries, leaving %d", n, before, c.Len())
+	}
+	if h, m := split(c); h != 0 || m != 1 {
+		t.Fatalf("pruned cache: got %d hits, %d misses", h, m)
+	}
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := m.Place(tmp, false); r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if n := c.Prune(tmp); n != 0 || c.Len() != 1 {
+		t.Fatalf("pruned %d, leaving %d entries; want 0 and 1", n, c.Len())
+	}
+
+	// as does changing the settings it was made with
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	HashAlgorithm = "sha256"
+	defer func() {
+		HashAlgorithm = "md5"
+	}()
+	c, err = OpenCache(CachePath(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 0 {
+		t.Fatalf("cache for other hash has %d entries, want 0", c.Len())
+	}
+}
+
+func singleton(p string) <-chan string {
+	c := make(chan string, 1)
+	c <- p
+	close(c)
+	return c
+}
+
+func TestPlan(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+
+	ts := time.Date(2012, 10, 21, 10, 30, 0, 0, time.UTC)
+	a := Media{
+		Path:      filepath.Join(wd, "testdata", "a.mov"),
+		Hash:      "60b725f10c9c85c70d97880dfe8191b3",
+		Time:      ts,
+		Extension: ".mov",
+	}
+	b := Media{
+		Path:      filepath.Join(wd, "testdata", "b.mov"),
+		Hash:      "3b5d5c3712955042212316173ccf37be",
+		Time:      ts,
+		Extension: ".mov",
+	}
+
+	p := NewPlanner(tmp)
+	results := []Result{p.Plan(a), p.Plan(b), p.Plan(a)}
+	expected := []string{
+		"date/2012/10/1350815400000000000.mov",
+		"date/2012/10/1350815400000000000_0000.mov",
+		"",
+	}
+	for i, r := range results {
+		if expected[i] == "" {
+			if _, ok := r.Err.(Dup); !ok {
+				t.Errorf("%d: expected Dup, got %v", i, r.Err)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, r.Err)
+		}
+		if r.Date != filepath.Join(tmp, expected[i]) {
+			t.Errorf("%d: got date %q, want %q", i, r.Date, expected[i])
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "date")); !os.IsNotExist(err) {
+		t.Errorf("planning touched the output tree: %v", err)
+	}
+
+	// taking keeps the duplicates that Take would
+	out := filepath.Join(tmp, "out")
+	if err := PrepOutput(out); err != nil {
+		t.Fatal(err)
+	}
+	lenna, err := ParseFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := lenna.Place(out, false); r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	withSidecar := lenna
+	withSidecar.Sidecar = filepath.Join(wd, "testdata", "lenna.xmp")
+	itself := lenna
+	itself.Path = lenna.Content(out)
+	changed := lenna
+	changed.Path = filepath.Join(tmp, "changed.png")
+	if err := ioutil.WriteFile(changed.Path, []byte("not lenna"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p = NewPlanner(out)
+	p.Take = true
+	tests := []struct {
+		m       Media
+		removed bool
+		err     error
+	}{
+		{m: a},
+		{m: a, removed: true, err: Dup{a.Content(out)}},
+		{m: lenna, removed: true, err: Dup{lenna.Content(out)}},
+		{m: withSidecar, err: Dup{lenna.Content(out)}},
+		{m: itself, err: Dup{lenna.Content(out)}},
+		{m: changed, err: Collision{Path: changed.Path, Content: lenna.Content(out)}},
+	}
+	for i, test := range tests {
+		r := p.Plan(test.m)
+		if r.Err != test.err {
+			t.Errorf("%d: got error %v, want %v", i, r.Err, test.err)
+		}
+		if r.Removed != test.removed {
+			t.Errorf("%d: got removed %t, want %t", i, r.Removed, test.removed)
+		}
+	}
+	if !exists(lenna.Path) || !exists(changed.Path) {
+		t.Error("planning removed an original")
+	}
+}
+
+func TestTake(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	out := filepath.Join(tmp, "out")
+	if err := PrepOutput(out); err != nil {
+		t.Fatal(err)
+	}
+
+	cp := func(src, name string) string {
+		b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(tmp, name)
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// linked into place and removed
+	p := cp("lenna.png", "lenna.png")
+	m, err := ParseFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Take(out); err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("original still exists after take: %v", err)
+	}
+	if _, err := os.Stat(m.Content(out)); err != nil {
+		t.Errorf("content missing after take: %v", err)
+	}
+
+	// duplicates are removed
+	p = cp("lenna.png", "lenna-again.png")
+	m, err = ParseFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Take(out); err == nil {
+		t.Fatal("expected dup")
+	} else if _, ok := err.(Dup); !ok {
+		t.Fatalf("expected Dup, got %v", err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("duplicate original still exists after take: %v", err)
+	}
+
+	// unless they aren't really the same
+	p = cp("stott.gif", "stott.gif")
+	m, err = ParseFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(m.Content(out), []byte("not the same"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Take(out); err == nil {
+		t.Fatal("expected collision")
+	} else if _, ok := err.(Collision); !ok {
+		t.Fatalf("expected Collision, got %v", err)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("original of collision was removed: %v", err)
+	}
+
+	// even when only their bytes differ
+	p = cp("lenna.png", "lenna-same-size.png")
+	m, err = ParseFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(m.Content(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err := os.Chmod(m.Content(out), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(m.Content(out), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Take(out); err == nil {
+		t.Fatal("expected collision")
+	} else if _, ok := err.(Collision); !ok {
+		t.Fatalf("expected Collision, got %v", err)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("original of same-size collision was removed: %v", err)
+	}
+
+	// and originals that changed since they were parsed are kept
+	p = cp("valid.jpg", "valid.jpg")
+	m, err = ParseFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Take(out); err == nil {
+		t.Fatal("expected verification failure")
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("changed original was removed: %v", err)
+	}
+	if _, err := os.Stat(m.Content(out)); !os.IsNotExist(err) {
+		t.Errorf("unverified content left in store: %v", err)
+	}
+}
+
+func TestCopyStrategy(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(s Strategy) {
+		CopyStrategy = s
+	}(CopyStrategy)
+
+	tests := []struct {
+		strategy Strategy
+		ok       []Strategy
+	}{
+		{Stream, []Strategy{Stream}},
+		{Auto, []Strategy{Clone, CopyRange, Stream}},
+		// may be unsupported, but must never fall back
+		{Clone, []Strategy{Clone}},
+		{CopyRange, []Strategy{CopyRange}},
+	}
+	for _, test := range tests {
+		tmp, err := ioutil.TempDir("", "arrange-tests-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		if err := PrepOutput(tmp); err != nil {
+			t.Fatal(err)
+		}
+
+		CopyStrategy = test.strategy
+		r := m.Place(tmp, false)
+		if r.Err != nil {
+			if test.strategy == Auto || test.strategy == Stream {
+				t.Errorf("%s: %v", test.strategy, r.Err)
+			}
+			if _, err := os.Stat(r.Content); !os.IsNotExist(err) {
+				t.Errorf("%s: failed copy left content behind: %v", test.strategy, err)
+			}
+			continue
+		}
+		found := false
+		for _, s := range test.ok {
+			found = found || s == r.Strategy
+		}
+		if !found {
+			t.Errorf("%s: copied with %q, want one of %v", test.strategy, r.Strategy, test.ok)
+		}
+		got, err := ioutil.ReadFile(r.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content differs from original", test.strategy)
+		}
+		if _, err := os.Stat(r.Date); err != nil {
+			t.Errorf("%s: date link missing: %v", test.strategy, err)
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+		HashAlgorithm = "md5"
+		Links = "hard"
+	}()
+
+	Links = "symbolic"
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := m.Place(tmp, false)
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	target, err := os.Readlink(r.Date)
+	if err != nil {
+		t.Fatalf("date entry is not a symlink: %v", err)
+	}
+	if want := filepath.Join("..", "..", "..", "content", m.Hash[:2], m.Hash[2:]+".png"); target != want {
+		t.Errorf("got link to %q, want %q", target, want)
+	}
+
+	missing := func() []Media {
+		in := make(chan Media, 1)
+		in <- m
+		close(in)
+		ms := []Media{}
+		s, errs := MissingLink(in, tmp)
+		go func() {
+			for err := range errs {
+				t.Errorf("missing link: %v", err)
+			}
+		}()
+		for m := range s {
+			ms = append(ms, m)
+		}
+		return ms
+	}
+
+	m.Path = r.Date
+	if got := missing(); len(got) != 0 {
+		t.Errorf("got %d missing links in a good tree, want 0", len(got))
+	}
+
+	// a hardlinked tree is converted by relinking what MissingLink finds
+	Links = "hard"
+	if got := missing(); len(got) != 1 {
+		t.Fatalf("got %d missing links for hard links, want 1", len(got))
+	}
+	if err := Relink(r.Date, r.Content); err != nil {
+		t.Fatal(err)
+	}
+	if got := missing(); len(got) != 0 {
+		t.Errorf("got %d missing links after relinking, want 0", len(got))
+	}
+	Links = "symbolic"
+	if err := Relink(r.Date, r.Content); err != nil {
+		t.Fatal(err)
+	}
+
+	// readdressed blobs leave forwarding links until they are resolved
+	HashAlgorithm = "sha256"
+	for err := range Readdress(Blobs(tmp), tmp) {
+		if err != nil {
+			t.Fatalf("readdress: %v", err)
+		}
+	}
+	if _, err := os.Stat(r.Date); err != nil {
+		t.Fatalf("date link broken by readdressing: %v", err)
+	}
+	if err := WriteConfig(tmp, Config{Hash: "sha256", Links: "symbolic"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResolveLinks(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(r.Content); !os.IsNotExist(err) {
+		t.Errorf("forwarding link left in store: %v", err)
+	}
+	m, err = ParseFile(r.Date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := missing(); len(got) != 0 {
+		t.Errorf("got %d missing links after resolving, want 0", len(got))
+	}
+}
+
+func TestAtomicMove(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	out := filepath.Join(tmp, "out")
+	if err := PrepOutput(out); err != nil {
+		t.Fatal(err)
+	}
+
+	temps := func() []string {
+		found := []string{}
+		filepath.Walk(filepath.Join(out, "content"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && strings.HasPrefix(info.Name(), tempPrefix) {
+				found = append(found, path)
+			}
+			return err
+		})
+		return found
+	}
+
+	// a file that changes after it is parsed never reaches its address
+	b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(tmp, "lenna.png")
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, b[:len(b)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Move(out); err == nil {
+		t.Fatal("expected verification failure")
+	}
+	if _, err := os.Stat(m.Content(out)); !os.IsNotExist(err) {
+		t.Errorf("truncated content left at its address: %v", err)
+	}
+	if got := temps(); len(got) != 0 {
+		t.Errorf("temporary files left behind: %v", got)
+	}
+
+	// stale temporary files are swept, fresh ones are not
+	stale := filepath.Join(out, "content", "00", tempPrefix+"stale")
+	fresh := filepath.Join(out, "content", "01", tempPrefix+"fresh")
+	// copySidecar leaves them in the date tree
+	staleDate := filepath.Join(out, "date", "2000", "01", tempPrefix+"stale")
+	if err := os.MkdirAll(filepath.Dir(staleDate), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{stale, fresh, staleDate} {
+		if err := ioutil.WriteFile(name, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * staleAge)
+	for _, name := range []string{stale, staleDate} {
+		if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := Sweep(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("swept %d files, want 2", n)
+	}
+	if got := temps(); len(got) != 1 || got[0] != fresh {
+		t.Errorf("got temporary files %v after sweep, want only %q", got, fresh)
+	}
+	if exists(staleDate) {
+		t.Errorf("%q not swept", staleDate)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	man, err := CreateManifest(tmp, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	hashes := map[string]string{}
+	for _, name := range []string{"lenna.png", "stott.gif", "valid.jpg"} {
+		m, err := ParseFile(filepath.Join(wd, "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := m.Place(tmp, false)
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		if err := man.Write(r); err != nil {
+			t.Fatal(err)
+		}
+		contents[name] = m.Content(tmp)
+		hashes[name] = m.Hash
+	}
+	if err := man.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFile(contents["lenna.png"], tmp); err != nil {
+		t.Errorf("intact blob: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(contents["stott.gif"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err := ioutil.WriteFile(contents["stott.gif"], b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(contents["valid.jpg"], 0); err != nil {
+		t.Fatal(err)
+	}
+	stray := filepath.Join(tmp, "content", "00", "not-a-hash.png")
+	if err := ioutil.WriteFile(stray, []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]error{}
+	for err := range Verify(Blobs(tmp), tmp) {
+		switch e := err.(type) {
+		case nil:
+		case Corrupt:
+			got[e.Path] = err
+		case Truncated:
+			got[e.Path] = err
+		case BadAddress:
+			got[e.Path] = err
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("got %d damaged blobs, want 3: %v", len(got), got)
+	}
+	if _, ok := got[contents["stott.gif"]].(Corrupt); !ok {
+		t.Errorf("flipped byte: got %v, want Corrupt", got[contents["stott.gif"]])
+	}
+	if _, ok := got[contents["valid.jpg"]].(Truncated); !ok {
+		t.Errorf("emptied blob: got %v, want Truncated", got[contents["valid.jpg"]])
+	}
+	if _, ok := got[stray].(BadAddress); !ok {
+		t.Errorf("stray file: got %v, want BadAddress", got[stray])
+	}
+
+	// the manifest remembers how big the blobs were
+	sizes, err := BlobSizes(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(wd, "testdata", "valid.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 3 || sizes[hashes["valid.jpg"]] != fi.Size() {
+		t.Errorf("got sizes %v, want 3 with %d for valid.jpg", sizes, fi.Size())
+	}
+}
+
+func TestFsck(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	results := map[string]Result{}
+	for _, name := range []string{"lenna.png", "stott.gif", "valid.jpg"} {
+		m, err := ParseFile(filepath.Join(wd, "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := m.Place(tmp, false)
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		results[name] = r
+	}
+
+	// orphan
+	if err := os.Remove(results["stott.gif"].Date); err != nil {
+		t.Fatal(err)
+	}
+	// dangling copy of something in the store
+	b, err := ioutil.ReadFile(results["lenna.png"].Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(results["lenna.png"].Date); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(results["lenna.png"].Date, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// dangling symlink to nothing
+	broken := filepath.Join(tmp, "date", "2000", "01", "broken.jpg")
+	if err := os.MkdirAll(filepath.Dir(broken), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "..", "..", "content", "00", "gone.jpg"), broken); err != nil {
+		t.Fatal(err)
+	}
+	// not entries
+	for _, name := range []string{".DS_Store", "2000/Thumbs.db", "2000/01/" + tempPrefix + "123"} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, "date", name), []byte("junk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// stray
+	stray := filepath.Join(tmp, "content", "00", "stray.png")
+	if err := ioutil.WriteFile(stray, []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]error{}
+	for err := range Fsck(tmp) {
+		switch e := err.(type) {
+		case Orphan:
+			got[e.Path] = err
+		case Dangling:
+			got[e.Path] = err
+		case BadAddress:
+			got[e.Path] = err
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	expected := map[string]error{
+		results["stott.gif"].Content: Orphan{results["stott.gif"].Content},
+		results["lenna.png"].Content: Orphan{results["lenna.png"].Content},
+		results["lenna.png"].Date:    Dangling{results["lenna.png"].Date},
+		broken:                       Dangling{broken},
+		stray:                        BadAddress{stray},
+	}
+	if len(got) != len(expected) {
+		t.Errorf("got %d problems, want %d: %v", len(got), len(expected), got)
+	}
+	for path, want := range expected {
+		if got[path] != want {
+			t.Errorf("%q: got %v, want %v", path, got[path], want)
+		}
+	}
+
+	for _, err := range got {
+		switch e := err.(type) {
+		case Orphan:
+			continue
+		case Dangling:
+			err = RepairDangling(e.Path, tmp)
+		case BadAddress:
+			err = Quarantine(e.Path, tmp)
+		}
+		if err != nil {
+			t.Errorf("repair: %v", err)
+		}
+	}
+	// relinking the copy of lenna claimed its blob
+	orphans := 0
+	for err := range Fsck(tmp) {
+		e, ok := err.(Orphan)
+		if !ok {
+			t.Errorf("after repair: %v", err)
+			continue
+		}
+		orphans++
+		if err := AdoptOrphan(e.Path, tmp); err != nil {
+			t.Errorf("adopt: %v", err)
+		}
+	}
+	if orphans != 1 {
+		t.Errorf("got %d orphans after relinking, want 1", orphans)
+	}
+	for err := range Fsck(tmp) {
+		t.Errorf("after repair: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, quarantineDir, "content", "00", "stray.png")); err != nil {
+		t.Errorf("stray not quarantined: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmp, quarantineDir, "date", "2000", "01", "broken.jpg")); err != nil {
+		t.Errorf("broken link not quarantined: %v", err)
+	}
+}
+
+func TestRepairSymlink(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	root := filepath.Join(tmp, "root")
+	if err := PrepOutput(root); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(tmp, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "date", "2000", "01")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// date entries that are symlinks to files outside the tree, not yet in
+	// the store, by absolute and by relative path
+	links := map[string]string{}
+	for name, target := range map[string]func(string) string{
+		"valid.jpg": func(p string) string { return p },
+		"lenna.png": func(p string) string {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return rel
+		},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		orig := filepath.Join(outside, name)
+		if err := ioutil.WriteFile(orig, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		entry := filepath.Join(dir, name)
+		if err := os.Symlink(target(orig), entry); err != nil {
+			t.Fatal(err)
+		}
+		links[entry] = orig
+	}
+
+	n := 0
+	for err := range Fsck(root) {
+		e, ok := err.(Dangling)
+		if !ok {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		n++
+		if err := RepairDangling(e.Path, root); err != nil {
+			t.Errorf("repair %q: %v", e.Path, err)
+		}
+	}
+	if n != len(links) {
+		t.Errorf("got %d dangling entries, want %d", n, len(links))
+	}
+	for err := range Fsck(root) {
+		t.Errorf("after repair: %v", err)
+	}
+
+	for entry, orig := range links {
+		sum, err := HashFile(orig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := Media{Hash: sum, Extension: filepath.Ext(orig)}
+		fi, err := os.Lstat(m.Content(root))
+		if err != nil {
+			t.Errorf("%q not added to the store: %v", orig, err)
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			t.Errorf("%q stored as %v, want a regular file", orig, fi.Mode())
+		}
+		if got, err := HashFile(entry); err != nil || got != sum {
+			t.Errorf("%q: got %q, %v; want %q", entry, got, err, sum)
+		}
+		if _, err := os.Stat(orig); err != nil {
+			t.Errorf("original %q: %v", orig, err)
+		}
+	}
+}
+
+func TestGarbage(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	results := []Result{}
+	for _, name := range []string{"lenna.png", "stott.gif"} {
+		m, err := ParseFile(filepath.Join(wd, "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := m.Place(tmp, false)
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		results = append(results, r)
+	}
+	// a file browser's litter is not a dangling entry
+	if err := ioutil.WriteFile(filepath.Join(tmp, "date", ".DS_Store"), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gs, err := FindGarbage(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gs) != 0 {
+		t.Fatalf("got %d garbage in a clean tree, want 0", len(gs))
+	}
+
+	if err := os.Remove(results[0].Date); err != nil {
+		t.Fatal(err)
+	}
+	gs, err = FindGarbage(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gs) != 1 || gs[0].Path != results[0].Content {
+		t.Fatalf("got garbage %v, want %q", gs, results[0].Content)
+	}
+
+	// when it was first found is remembered
+	then := time.Date(2017, 7, 23, 0, 0, 0, 0, time.UTC)
+	gs[0].Since = then
+	if err := SaveGarbage(tmp, gs); err != nil {
+		t.Fatal(err)
+	}
+	gs, err = FindGarbage(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gs) != 1 || !gs[0].Since.Equal(then) {
+		t.Fatalf("got garbage %v, want it found at %v", gs, then)
+	}
+
+	if err := Discard(gs[0].Path, tmp, true); err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(tmp, gs[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, trashDir, rel)); err != nil {
+		t.Errorf("garbage not in trash: %v", err)
+	}
+	for err := range Fsck(tmp) {
+		t.Errorf("after collecting: %v", err)
+	}
+
+	// copies in the date tree make content look unreferenced
+	if err := os.Remove(results[1].Date); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(results[1].Date, []byte("copy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindGarbage(tmp); err == nil {
+		t.Error("expected refusal with dangling date entries")
+	}
+}
+
+func TestTimeSource(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		source string
+	}{
+		// its Exif sub-IFD is damaged, leaving only IFD0's DateTime
+		{"exif-decode-error.jpg", TimeDateTime},
+		{"no-exif-but-good.jpg", TimeMtime},
+		{"lenna.png", TimeMtime},
+		{"exif.heic", TimeExif},
+		{"exif.cr2", TimeExif},
+		{"a.mp4", TimeContainer},
+		{"creationdate.mov", TimeContainer},
+		{"idit.avi", TimeContainer},
+		{"strd.avi", TimeExif},
+	}
+	for _, test := range tests {
+		m, err := ParseFile(filepath.Join(wd, "testdata", test.name))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if m.TimeSource != test.source {
+			t.Errorf("%s: got time from %q, want %q", test.name, m.TimeSource, test.source)
+		}
+	}
+
+	defer func(sources []string) {
+		TimePrecedence = sources
+	}(TimePrecedence)
+	for _, bad := range [][]string{nil, {TimeExif, "sundial"}, {TimeMtime, TimeMtime}} {
+		if err := CheckPrecedence(bad); err == nil {
+			t.Errorf("accepted time sources %v", bad)
+		}
+	}
+	TimePrecedence = []string{TimeExif, TimeMtime}
+	m, err := ParseFile(filepath.Join(wd, "testdata", "exif-decode-error.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TimeSource != TimeMtime {
+		t.Errorf("exif-decode-error.jpg: got time from %q, want %q", m.TimeSource, TimeMtime)
+	}
+	TimePrecedence = []string{TimeMtime, TimeExif}
+	if m, err := ParseFile(filepath.Join(wd, "testdata", "offset.jpg")); err != nil || m.TimeSource != TimeMtime {
+		t.Errorf("offset.jpg: got time from %q (%v), want %q", m.TimeSource, err, TimeMtime)
+	}
+	TimePrecedence = []string{TimeExif, TimeContainer}
+	if _, err := ParseFile(filepath.Join(wd, "testdata", "lenna.png")); err == nil {
+		t.Error("lenna.png parsed without any of its time sources")
+	}
+}
+
+func TestTimeZone(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both were taken at 00:30 on New Year's Day, nine hours ahead of UTC.
+	tests := []struct {
+		name string
+		zone string
+	}{
+		{"offset.jpg", ZoneOffset},
+		{"gps.jpg", ZoneGPS},
+	}
+	want := time.Date(2019, 12, 31, 15, 30, 0, 0, time.UTC)
+	defer func() {
+		DateZone = CaptureZone
+	}()
+	for _, test := range tests {
+		m, err := ParseFile(filepath.Join(wd, "testdata", test.name))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if m.Zone != test.zone {
+			t.Errorf("%s: got zone from %q, want %q", test.name, m.Zone, test.zone)
+		}
+		if !m.Time.Equal(want) {
+			t.Errorf("%s: got %v, want %v", test.name, m.Time, want)
+		}
+		if _, off := m.Time.Zone(); off != 9*60*60 {
+			t.Errorf("%s: got offset %ds, want 9h", test.name, off)
+		}
+
+		for zone, prefix := range map[string]string{CaptureZone: "2020/01/", "UTC": "2019/12/"} {
+			DateZone = zone
+			got, err := m.datePath(DefaultTemplate, DateZone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(filepath.ToSlash(got), prefix) {
+				t.Errorf("%s: in zone %s got %q, want it in %q", test.name, zone, got, prefix)
+			}
+		}
+	}
+
+	// a GPS fix only gives an offset if it agrees with the clock
+	utc := time.Date(2019, 12, 31, 15, 30, 0, 0, time.UTC)
+	offsets := []struct {
+		wall time.Time
+		off  time.Duration
+		ok   bool
+	}{
+		{utc.Add(9 * time.Hour), 9 * time.Hour, true},
+		{utc.Add(9*time.Hour + 2*time.Minute), 9 * time.Hour, true},
+		{utc.Add(-5*time.Hour - 31*time.Minute), -5*time.Hour - 30*time.Minute, true},
+		{utc.Add(9*time.Hour + 7*time.Minute), 0, false},
+		{utc.Add(20 * time.Hour), 0, false},
+	}
+	for _, test := range offsets {
+		off, ok := gpsOffset(test.wall, utc)
+		if ok != test.ok || (ok && off != test.off) {
+			t.Errorf("%v against %v: got %v, %t; want %v, %t", test.wall, utc, off, ok, test.off, test.ok)
+		}
+	}
+
+	m, err := ParseFile(filepath.Join(wd, "testdata", "a.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Zone != ZoneUTC {
+		t.Errorf("a.mp4: got zone from %q, want %q", m.Zone, ZoneUTC)
+	}
+
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	DateZone = "UTC"
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+	DateZone = CaptureZone
+	if err := PrepOutput(tmp); err == nil {
+		t.Fatal("tree laid out in UTC accepted the capture zone")
+	}
+	DateZone = "Nowhere/Special"
+	if err := PrepOutput(tmp); err == nil {
+		t.Fatal("bogus zone accepted")
+	}
+}
+
+func TestSkew(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+
+	rules := filepath.Join(tmp, "skew.json")
+	bad := `[{"years": 1}]`
+	if err := ioutil.WriteFile(rules, []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSkews(rules); err == nil {
+		t.Fatal("rule for no camera accepted")
+	}
+
+	// serial.jpg is from the body with serial 012345; offset.jpg is from
+	// another of the same model, but before its rule starts.
+	good := `[
+		{"serial": "012345", "years": -1, "offset": "-1h"},
+		{"model": "canon eos 5d mark iii", "from": "2021-01-01T00:00:00Z", "offset": "2h"}
+	]`
+	if err := ioutil.WriteFile(rules, []byte(good), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := settings()
+	if Skews, err = LoadSkews(rules); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		Skews = nil
+	}()
+	if settings() == before {
+		t.Error("cache settings ignore skew rules")
+	}
+
+	m, err := ParseFile(filepath.Join(wd, "testdata", "offset.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Skew != 0 {
+		t.Errorf("offset.jpg: corrected by %v outside its rule's range", m.Skew)
+	}
+
+	m, err = ParseFile(filepath.Join(wd, "testdata", "serial.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2018, 12, 31, 14, 30, 0, 0, time.UTC)
+	if !m.Time.Equal(want) {
+		t.Errorf("serial.jpg: got %v, want %v", m.Time, want)
+	}
+	if want := -(365*24 + 1) * time.Hour; m.Skew != want {
+		t.Errorf("serial.jpg: corrected by %v, want %v", m.Skew, want)
+	}
+
+	out := filepath.Join(tmp, "out")
+	if err := PrepOutput(out); err != nil {
+		t.Fatal(err)
+	}
+	man, err := CreateManifest(out, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := man.Write(m.Place(out, false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := man.Close(); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := ReadManifest(man.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Skew != "-8761h0m0s" {
+		t.Errorf("got records %+v, want one with its skew", recs)
+	}
+}
+
+func TestNameTime(t *testing.T) {
+	tests := []struct {
+		name string
+		want time.Time
+	}{
+		{"IMG_20190704_153012.jpg", time.Date(2019, 7, 4, 15, 30, 12, 0, time.Local)},
+		{"PXL_20190704_153012345.jpg", time.Date(2019, 7, 4, 15, 30, 12, 0, time.Local)},
+		{"Screenshot 2019-07-04 at 15.30.12.png", time.Date(2019, 7, 4, 15, 30, 12, 0, time.Local)},
+		{"VID-20190704-WA0003.mp4", time.Date(2019, 7, 4, 0, 0, 0, 0, time.Local)},
+		{"holiday 2019-07-04 (2).gif", time.Date(2019, 7, 4, 0, 0, 0, 0, time.Local)},
+		{"IMG_20191304_153012.jpg", time.Time{}},
+		{"DSC01234.jpg", time.Time{}},
+	}
+	for _, test := range tests {
+		got, ok := nameTime(filepath.Join("somewhere", test.name))
+		if ok != !test.want.IsZero() || !got.Equal(test.want) {
+			t.Errorf("%s: got %v, %t; want %v", test.name, got, ok, test.want)
+		}
+	}
+
+	if _, err := CompileNamePattern(`(?P<year>\d{4})(?P<month>\d{2})`); err == nil {
+		t.Error("name pattern without a day accepted")
+	}
+	re, err := CompileNamePattern(`^scan(?P<day>\d{2})(?P<month>\d{2})(?P<year>\d{4})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	NamePatterns = append(NamePatterns, re)
+	defer func() {
+		NamePatterns = nil
+	}()
+	want := time.Date(2019, 7, 4, 0, 0, 0, 0, time.Local)
+	if got, ok := nameTime("scan04072019.png"); !ok || !got.Equal(want) {
+		t.Errorf("scan04072019.png: got %v, %t; want %v", got, ok, want)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmp, "Screenshot 2019-07-04 at 15.30.12.png")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TimeSource != TimeFilename || m.Time.Hour() != 15 {
+		t.Errorf("got %v from %q, want 15:30:12 from the name", m.Time, m.TimeSource)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	man, err := CreateManifest(tmp, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"exif.heic", "lenna.png", "exif.heic"} {
+		m, err := ParseFile(filepath.Join(wd, "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := man.Write(m.Place(tmp, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// files that couldn't be parsed are recorded too
+	notes := filepath.Join(tmp, "notes.txt")
+	if err := ioutil.WriteFile(notes, []byte("not media"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gone := filepath.Join(tmp, "gone.jpg")
+	in := make(chan string, 2)
+	in <- notes
+	in <- gone
+	close(in)
+	for range ParseReport(in, func(r Result) {
+		if err := man.Write(r); err != nil {
+			t.Error(err)
+		}
+	}) {
+	}
+	if err := man.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(man.Name()) != filepath.Join(tmp, ManifestDir) {
+		t.Errorf("manifest written to %q, not %s", man.Name(), ManifestDir)
+	}
+
+	b, err := ioutil.ReadFile(man.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d records, want 5", len(lines))
+	}
+	expected := []struct {
+		source, outcome, timeSource string
+	}{
+		{filepath.Join(wd, "testdata", "exif.heic"), "moved", TimeExif},
+		{filepath.Join(wd, "testdata", "lenna.png"), "moved", TimeMtime},
+		{filepath.Join(wd, "testdata", "exif.heic"), "dup", TimeExif},
+		{notes, "error", ""},
+		{gone, "error", ""},
+	}
+	for i, line := range lines {
+		rec := Record{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		want := expected[i]
+		if rec.Source != want.source {
+			t.Errorf("%d: got source %q, want %q", i, rec.Source, want.source)
+		}
+		if rec.Outcome != want.outcome {
+			t.Errorf("%d: got outcome %q, want %q", i, rec.Outcome, want.outcome)
+		}
+		if rec.TimeSource != want.timeSource {
+			t.Errorf("%d: got time source %q, want %q", i, rec.TimeSource, want.timeSource)
+		}
+		if want.outcome == "error" {
+			if rec.Content != "" || rec.Error == "" {
+				t.Errorf("%d: got content %q and error %q for a file that wasn't parsed", i, rec.Content, rec.Error)
+			}
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(tmp, rec.Content)); err != nil {
+			t.Errorf("%d: content not relative to root: %v", i, err)
+		}
+		if (rec.Date == "") != (want.outcome == "dup") {
+			t.Errorf("%d: got date %q for %s", i, rec.Date, want.outcome)
+		}
+	}
+}
+
+func TestUndo(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	out := filepath.Join(tmp, "out")
+	if err := PrepOutput(out); err != nil {
+		t.Fatal(err)
+	}
+
+	// an earlier run
+	m, err := ParseFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := m.Place(out, false)
+	if before.Err != nil {
+		t.Fatal(before.Err)
+	}
+
+	// the run to undo takes copies, and copies from testdata
+	man, err := CreateManifest(out, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	originals := map[string][]byte{}
+	for _, name := range []string{"lenna.png", "exif.heic", "stott.gif"} {
+		b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(tmp, name)
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		originals[p] = b
+		m, err := ParseFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := man.Write(m.Place(out, name != "stott.gif")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := man.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := ReadManifest(man.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("got %d records, want 3", len(recs))
+	}
+	// an interrupted undo's leftovers beside the originals
+	stale := filepath.Join(tmp, tempPrefix+"stale")
+	fresh := filepath.Join(tmp, tempPrefix+"fresh")
+	for _, name := range []string{stale, fresh} {
+		if err := ioutil.WriteFile(name, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * staleAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Undo(man.Name(), out); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(stale) || !exists(fresh) {
+		t.Errorf("got stale %t, fresh %t after undo; want only fresh", exists(stale), exists(fresh))
+	}
+	for p, want := range originals {
+		got, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("original not restored: %v", err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%q restored with different content", p)
+		}
+	}
+	for _, p := range []string{before.Content, before.Date} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("undo touched content from an earlier run: %v", err)
+		}
+	}
+	for _, rec := range recs[1:] {
+		for _, p := range []string{rec.Content, rec.Date} {
+			if _, err := os.Lstat(filepath.Join(out, p)); !os.IsNotExist(err) {
+				t.Errorf("%q survived undo: %v", p, err)
+			}
+		}
+	}
+	for err := range Fsck(out) {
+		t.Errorf("after undo: %v", err)
+	}
+}
+
+func TestUndoShared(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	out := filepath.Join(tmp, "out")
+	if err := PrepOutput(out); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", "exif.heic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// run a copies x, then run b moves the same content from y, which is
+	// removed as a dup of what a added
+	start := time.Now()
+	runs := []struct {
+		src  string
+		move bool
+	}{
+		{filepath.Join(tmp, "x.heic"), false},
+		{filepath.Join(tmp, "y.heic"), true},
+	}
+	manifests := []string{}
+	for i, run := range runs {
+		if err := ioutil.WriteFile(run.src, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ParseFile(run.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		man, err := CreateManifest(out, start.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := m.Place(out, run.move)
+		if err := man.Write(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := man.Close(); err != nil {
+			t.Fatal(err)
+		}
+		manifests = append(manifests, man.Name())
+	}
+	if exists(runs[1].src) {
+		t.Fatal("dup not removed")
+	}
+
+	if err := Undo(manifests[0], out); err != nil {
+		t.Fatal(err)
+	}
+	if err := Undo(manifests[1], out); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(runs[1].src); err != nil || !bytes.Equal(got, b) {
+		t.Errorf("dup removed by a later run not restored: %v", err)
+	}
+}
+
+func TestDateTemplate(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		DateTemplate = DefaultTemplate
+		DateZone = CaptureZone
+	}()
+
+	bad := []string{
+		"../{{.Year}}/{{.UnixNano}}{{.Ext}}",
+		"/{{.Year}}/{{.UnixNano}}{{.Ext}}",
+		"{{.Year}}/{{.UnixNano}}",
+		"{{.Year}}/{{.Nope}}{{.Ext}}",
+		"{{.Year}/{{.UnixNano}}{{.Ext}}",
+		"{{.Year}}/{{.UnixNano}}.jpg",
+		"{{.Year}}/{{.Path}}{{.Ext}}",
+	}
+	for _, text := range bad {
+		tmp, err := ioutil.TempDir("", "arrange-tests-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		DateTemplate = text
+		if err := PrepOutput(tmp); err == nil {
+			t.Errorf("%q: expected error", text)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	DateTemplate = `{{.Year}}/{{.Month}}-{{.MonthName}}/{{.Time.Format "2006-01-02_150405"}}_{{.Hash|short}}{{.Ext}}`
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseFile(filepath.Join(wd, "testdata", "exif.heic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := m.Place(tmp, false)
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	want := filepath.Join(tmp, "date", "2018", "12-December", "2018-12-25_073000_"+m.Hash[:8]+".heic")
+	if r.Date != want {
+		t.Errorf("got date %q, want %q", r.Date, want)
+	}
+
+	// collisions are numbered before the extension; mtimes are in the
+	// host's zone, so pin the date to one
+	DateTemplate = `{{.Time.Format "2006-01-02"}}{{.Ext}}`
+	DateZone = "UTC"
+	tmp, err = ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := PrepOutput(tmp); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", "lenna.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2012, 10, 21, 10, 30, 0, 0, time.UTC)
+	expected := []string{"2012-10-21.png", "2012-10-21_0000.png", "2012-10-21_0001.png"}
+	for i, name := range expected {
+		p := filepath.Join(tmp, fmt.Sprintf("lenna-%d.png", i))
+		if err := ioutil.WriteFile(p, append(b, byte(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, ts, ts); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ParseFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := m.Place(tmp, false)
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		if r.Date != filepath.Join(tmp, "date", name) {
+			t.Errorf("%d: got date %q, want %q", i, r.Date, name)
+		}
+	}
+
+	DateTemplate = DefaultTemplate
+	if err := CheckConfig(tmp); err == nil {
+		t.Error("expected error checking tree with another template")
+	}
+}
+
+func TestSharedSidecar(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+	in := filepath.Join(tmp, "in")
+	if err := os.MkdirAll(in, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(tmp, "out")
+	if err := PrepOutput(out); err != nil {
+		t.Fatal(err)
+	}
+
+	// a raw file and the JPEG shot with it, sharing one sidecar
+	for src, name := range map[string]string{
+		"exif.cr2":  "IMG_5678.cr2",
+		"valid.jpg": "IMG_5678.jpg",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(in, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sidecar := filepath.Join(in, "IMG_5678.xmp")
+	packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:Rating="3"/>
+</rdf:RDF></x:xmpmeta>`
+	if err := ioutil.WriteFile(sidecar, []byte(packet), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var media []Media
+	for p := range Source(in) {
+		m, err := ParseFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Sidecar != sidecar {
+			t.Errorf("%s: got sidecar %q, want %q", p, m.Sidecar, sidecar)
+		}
+		media = append(media, m)
+	}
+	if len(media) != 2 {
+		t.Fatalf("sourced %d files, want 2", len(media))
+	}
+	for i, m := range media {
+		r := m.Place(out, true)
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		if b, err := ioutil.ReadFile(r.Sidecar); err != nil || string(b) != packet {
+			t.Errorf("%s: sidecar not carried to %q: %v", m.Path, r.Sidecar, err)
+		}
+		last := i == len(media)-1
+		if exists(sidecar) == last {
+			t.Errorf("%s: original sidecar exists %t after taking %d of %d", m.Path, exists(sidecar), i+1, len(media))
+		}
+	}
+}
+
+func TestXMP(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		want   time.Time
+		rating int
+	}{
+		{"xmp.jpg", time.Date(2019, 7, 4, 13, 30, 12, 0, time.UTC), 4},
+		{"xmp.png", time.Date(2019, 7, 4, 15, 30, 12, 0, time.Local), -1},
+	}
+	for _, test := range tests {
+		m, err := ParseFile(filepath.Join(wd, "testdata", test.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.TimeSource != TimeXMP || !m.Time.Equal(test.want) {
+			t.Errorf("%s: got %v from %q, want %v from xmp", test.name, m.Time, m.TimeSource, test.want)
+		}
+		if m.Rating != test.rating {
+			t.Errorf("%s: got rating %d, want %d", test.name, m.Rating, test.rating)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "arrange-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(tmp)
+	}()
+
+	// a sidecar overrides the file's own XMP, field by field
+	b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", "xmp.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded := time.Date(2019, 7, 4, 13, 30, 12, 0, time.UTC)
+	edited := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	overrides := []struct {
+		attrs  string
+		want   time.Time
+		rating int
+	}{
+		{`xmp:CreateDate="2018-01-02T03:04:05Z" xmp:Rating="2"`, edited, 2},
+		{`xmp:CreateDate="2018-01-02T03:04:05Z"`, edited, 4},
+		{`xmp:Rating="1"`, embedded, 1},
+	}
+	for i, test := range overrides {
+		p := filepath.Join(tmp, fmt.Sprintf("override%d.jpg", i))
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/" ` + test.attrs + `/>
+</rdf:RDF></x:xmpmeta>`
+		if err := ioutil.WriteFile(p+sidecarExt, []byte(packet), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ParseFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.TimeSource != TimeXMP || !m.Time.Equal(test.want) || m.Rating != test.rating {
+			t.Errorf("%s: got %v from %q rated %d, want %v from xmp rated %d", test.attrs, m.Time, m.TimeSource, m.Rating, test.want, test.rating)
+		}
+	}
+
+	in := filepath.Join(tmp, "in")
+	if err := os.MkdirAll(in, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(tmp, "out")
+	if err := PrepOutput(out); err != nil {
+		t.Fatal(err)
+	}
+
+	// one sidecar named for the whole file, one for its base name
+	sidecars := map[string]string{
+		"exif.cr2":  "IMG_1234.cr2.xmp",
+		"lenna.png": "shot.xmp",
+	}
+	names := map[string]string{
+		"exif.cr2":  "IMG_1234.cr2",
+		"lenna.png": "shot.png",
+	}
+	packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:CreateDate="2019-07-04T15:30:12Z" xmp:Rating="5"/>
+</rdf:RDF></x:xmpmeta>`
+
+	man, err := CreateManifest(out, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []Result
+	for src, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(wd, "testdata", src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(in, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(in, sidecars[src]), []byte(packet), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for p := range Source(in) {
+		if isSidecar(p) {
+			t.Errorf("sidecar %q sourced as media", p)
+		}
+		m, err := ParseFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Sidecar == "" || m.Rating != 5 {
+			t.Errorf("%s: got sidecar %q and rating %d", p, m.Sidecar, m.Rating)
+		}
+		if filepath.Ext(p) == ".png" && m.TimeSource != TimeXMP {
+			t.Errorf("%s: got time from %q, want the sidecar", p, m.TimeSource)
+		}
+		if filepath.Ext(p) == ".cr2" && m.TimeSource != TimeExif {
+			t.Errorf("%s: got time from %q, want exif over the sidecar", p, m.TimeSource)
+		}
+		r := m.Place(out, true)
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		if err := man.Write(r); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, r)
+	}
+	if err := man.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range results {
+		want := strings.TrimSuffix(r.Date, r.Media.Extension) + ".xmp"
+		if strings.HasSuffix(r.Media.Sidecar, ".cr2.xmp") {
+			want = r.Date + ".xmp"
+		}
+		if r.Sidecar != want {
+			t.Errorf("%s: sidecar carried to %q, want %q", r.Media.Path, r.Sidecar, want)
+		}
+		if b, err := ioutil.ReadFile(r.Sidecar); err != nil || string(b) != packet {
+			t.Errorf("%s: sidecar not carried: %v", r.Media.Path, err)
+		}
+		if exists(r.Media.Sidecar) {
+			t.Errorf("%s: original sidecar left behind", r.Media.Path)
+		}
+	}
+	for err := range Fsck(out) {
+		t.Errorf("fsck: %v", err)
+	}
+
+	if err := Undo(man.Name(), out); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if !exists(r.Media.Sidecar) {
+			t.Errorf("%s: sidecar not restored", r.Media.Path)
+		}
+		if exists(r.Sidecar) {
+			t.Errorf("%s: carried sidecar not removed", r.Media.Path)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package arrange
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// box is a single ISO base media file format (ISO/IEC 14496-12) box, as used
+// by QuickTime, MP4 and HEIF containers.
+type box struct {
+	typ string
+	// start and end are the offsets of the box payload within the file.
+	start int64
+	end   int64
+}
+
+func (b box) size() int64 {
+	return b.end - b.start
+}
+
+var errNoBox = errors.New("box not found")
+
+// boxes returns the boxes that are laid out back to back between offsets start
+// and end of r.
+func boxes(r io.ReadSeeker, start, end int64) ([]box, error) {
+	var bs []box
+	hdr := make([]byte, 16)
+	for off := start; off+8 <= end; {
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+			return nil, err
+		}
+		b := box{typ: string(hdr[4:8])}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch size {
+		case 0:
+			// extends to the end of the enclosing box
+			b.start = off + 8
+			size = end - off
+		case 1:
+			if _, err := io.ReadFull(r, hdr[8:16]); err != nil {
+				return nil, err
+			}
+			b.start = off + 16
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		default:
+			b.start = off + 8
+		}
+		if size < b.start-off || off+size > end {
+			return nil, fmt.Errorf("malformed %q box at offset %d", b.typ, off)
+		}
+		b.end = off + size
+		bs = append(bs, b)
+		off = b.end
+	}
+	return bs, nil
+}
+
+// child returns the first box of type typ within parent's payload, skipping
+// skip bytes of header (e.g. a full box's version and flags) first.
+func child(r io.ReadSeeker, parent box, skip int64, typ string) (box, error) {
+	bs, err := boxes(r, parent.start+skip, parent.end)
+	if err != nil {
+		return box{}, err
+	}
+	for _, b := range bs {
+		if b.typ == typ {
+			return b, nil
+		}
+	}
+	return box{}, errNoBox
+}
+
+// payload reads the entire payload of b.
+func payload(r io.ReadSeeker, b box) ([]byte, error) {
+	if b.size() < 0 {
+		return nil, ErrFormat
+	}
+	if b.size() > 1<<24 {
+		return nil, fmt.Errorf("%q box too large to read: %d bytes", b.typ, b.size())
+	}
+	if _, err := r.Seek(b.start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, b.size())
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// whole returns a pseudo-box spanning all of r.
+func whole(r io.ReadSeeker) (box, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return box{}, err
+	}
+	return box{typ: "file", end: end}, nil
+}
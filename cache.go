@@ -0,0 +1,239 @@
+package arrange
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheName is where a tree keeps its Cache, relative to its root.
+const CacheName = "cache.gob"
+
+// cacheKey identifies a file that hasn't changed since it was parsed. Ctime
+// catches changes that put the mtime back, which the file's owner can do but
+// cannot do to the ctime.
+type cacheKey struct {
+	Dev   uint64
+	Ino   uint64
+	Size  int64
+	Mtime int64
+	Ctime int64
+}
+
+// cacheEntry is what is remembered of a parsed file.
+type cacheEntry struct {
+	// Name is the base name the file was parsed under. Its time,
+	// Extension and Misnamed may come from its name, so a renamed file is
+	// parsed again.
+	Name       string
+	Hash       string
+	Extension  string
+	Misnamed   string
+	Time       time.Time
+	TimeSource string
+	Zone       string
+	Skew       time.Duration
+	Rating     int
+}
+
+type cacheFile struct {
+	Settings string
+	Entries  map[cacheKey]cacheEntry
+}
+
+// Cache remembers the results of ParseFile for files that have not changed
+// since, so that they needn't be read again.
+type Cache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[cacheKey]cacheEntry
+}
+
+// cacheVersion changes whenever cacheKey or cacheEntry does.
+const cacheVersion = 7
+
+// settings summarizes the package settings that affect ParseFile, so that a
+// Cache made with others is not trusted.
+func settings() string {
+	return fmt.Sprintf("v%d hash=%s sniff=%t time=%s names=%s skew=%s", cacheVersion, HashAlgorithm, Sniff, strings.Join(TimePrecedence, ","), nameDigest(), skewDigest())
+}
+
+// NewCache returns an empty Cache that will be saved at path.
+func NewCache(path string) *Cache {
+	return &Cache{
+		path:    path,
+		entries: map[cacheKey]cacheEntry{},
+	}
+}
+
+// OpenCache loads the Cache saved at path. A missing cache, or one saved with
+// different settings, is returned empty.
+func OpenCache(path string) (*Cache, error) {
+	c := NewCache(path)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("problem opening cache: %v", err)
+	}
+	defer f.Close()
+
+	cf := cacheFile{}
+	if err := gob.NewDecoder(f).Decode(&cf); err != nil {
+		return nil, fmt.Errorf("problem reading cache %q: %v", path, err)
+	}
+	if cf.Settings == settings() && cf.Entries != nil {
+		c.entries = cf.Entries
+	}
+	return c, nil
+}
+
+// Save writes c back to its path.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("problem creating cache: %v", err)
+	}
+	cf := cacheFile{Settings: settings(), Entries: c.entries}
+	if err := gob.NewEncoder(f).Encode(cf); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("problem writing cache: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("problem writing cache: %v", err)
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Prune forgets the files whose content is no longer in root's store, as
+// after gc or undo, so that c doesn't grow with every file it has ever seen.
+// It returns how many were forgotten.
+func (c *Cache) Prune(root string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k, e := range c.entries {
+		m := Media{Hash: e.Hash, Extension: e.Extension}
+		if !exists(m.Content(root)) {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of files c knows about.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// lookup returns the Media remembered for path, if it is unchanged and still
+// has the same name. Files with sidecars are never remembered, since the
+// sidecar can change on its own.
+func (c *Cache) lookup(path string) (Media, bool) {
+	fi, err := os.Stat(path)
+	if err != nil || findSidecar(path) != "" {
+		return Media{}, false
+	}
+	k, ok := keyFor(fi)
+	if !ok {
+		return Media{}, false
+	}
+	c.mu.Lock()
+	e, ok := c.entries[k]
+	c.mu.Unlock()
+	if !ok || e.Name != filepath.Base(path) {
+		return Media{}, false
+	}
+	return Media{
+		Path:       path,
+		Hash:       e.Hash,
+		Extension:  e.Extension,
+		Misnamed:   e.Misnamed,
+		Time:       e.Time,
+		TimeSource: e.TimeSource,
+		Zone:       e.Zone,
+		Skew:       e.Skew,
+		Rating:     e.Rating,
+	}, true
+}
+
+// store remembers m.
+func (c *Cache) store(m Media) {
+	if m.Sidecar != "" {
+		return
+	}
+	fi, err := os.Stat(m.Path)
+	if err != nil {
+		return
+	}
+	k, ok := keyFor(fi)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	c.entries[k] = cacheEntry{
+		Name:       filepath.Base(m.Path),
+		Hash:       m.Hash,
+		Extension:  m.Extension,
+		Misnamed:   m.Misnamed,
+		Time:       m.Time,
+		TimeSource: m.TimeSource,
+		Zone:       m.Zone,
+		Skew:       m.Skew,
+		Rating:     m.Rating,
+	}
+	c.mu.Unlock()
+}
+
+// Split looks up each path on input chan in c. Media for files that are
+// unchanged are sent down the first output chan, and the paths of files that
+// need parsing down the second. Both must be drained.
+func (c *Cache) Split(in <-chan string) (<-chan Media, <-chan string) {
+	hits := make(chan Media)
+	misses := make(chan string)
+	go func() {
+		for path := range in {
+			if m, ok := c.lookup(path); ok {
+				hits <- m
+			} else {
+				misses <- path
+			}
+		}
+		close(hits)
+		close(misses)
+	}()
+	return hits, misses
+}
+
+// Remember stores each Media on input chan in c, and sends it on down output
+// chan.
+func (c *Cache) Remember(in <-chan Media) <-chan Media {
+	out := make(chan Media)
+	go func() {
+		for m := range in {
+			c.store(m)
+			out <- m
+		}
+		close(out)
+	}()
+	return out
+}
+
+// CachePath returns where the tree at root keeps its Cache.
+func CachePath(root string) string {
+	return filepath.Join(root, CacheName)
+}
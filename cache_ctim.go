@@ -0,0 +1,10 @@
+//go:build dragonfly || linux || openbsd || solaris
+// +build dragonfly linux openbsd solaris
+
+package arrange
+
+import "syscall"
+
+func ctime(st *syscall.Stat_t) int64 {
+	return st.Ctim.Nano()
+}
@@ -0,0 +1,10 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package arrange
+
+import "syscall"
+
+func ctime(st *syscall.Stat_t) int64 {
+	return st.Ctimespec.Nano()
+}
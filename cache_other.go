@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package arrange
+
+import "os"
+
+// keyFor needs inode numbers to tell files apart safely, so nothing is cached
+// on platforms without them.
+func keyFor(fi os.FileInfo) (cacheKey, bool) {
+	return cacheKey{}, false
+}
@@ -0,0 +1,23 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package arrange
+
+import (
+	"os"
+	"syscall"
+)
+
+func keyFor(fi os.FileInfo) (cacheKey, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return cacheKey{}, false
+	}
+	return cacheKey{
+		Dev:   uint64(st.Dev),
+		Ino:   uint64(st.Ino),
+		Size:  fi.Size(),
+		Mtime: fi.ModTime().UnixNano(),
+		Ctime: ctime(st),
+	}, true
+}
@@ -0,0 +1,96 @@
+package arrange
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Strategy is how a file's data got (or is to get) into the content store.
+type Strategy string
+
+const (
+	// Auto tries Clone, then CopyRange, then Stream.
+	Auto Strategy = "auto"
+	// Clone shares the original's extents on copy-on-write filesystems such
+	// as Btrfs and XFS.
+	Clone Strategy = "clone"
+	// CopyRange copies within the kernel with copy_file_range, on Linux.
+	CopyRange Strategy = "range"
+	// Stream copies through userspace with io.Copy.
+	Stream Strategy = "stream"
+
+	// Staged files were copied while they were parsed.
+	Staged Strategy = "staged"
+	// Linked files were hardlinked into place by Take.
+	Linked Strategy = "link"
+)
+
+// CopyStrategy is how Move copies files that weren't staged. Anything but
+// Auto is used without fallback.
+var CopyStrategy = Auto
+
+var errUnsupported = errors.New("not supported on this platform")
+
+// copyFile copies src to dst using CopyStrategy, and reports which strategy
+// worked.
+func copyFile(dst, src *os.File) (Strategy, error) {
+	var err error
+	switch CopyStrategy {
+	case Auto:
+		if err = cloneFile(dst, src); err == nil {
+			return Clone, nil
+		}
+		if err = rewind(dst, src); err != nil {
+			return Auto, err
+		}
+		if err = copyRange(dst, src); err == nil {
+			return CopyRange, nil
+		}
+		if err = rewind(dst, src); err != nil {
+			return Auto, err
+		}
+		fallthrough
+	case Stream:
+		// hide dst's ReadFrom so this really is a userspace copy
+		_, err = io.Copy(struct{ io.Writer }{dst}, src)
+		return Stream, err
+	case Clone:
+		return Clone, cloneFile(dst, src)
+	case CopyRange:
+		return CopyRange, copyRange(dst, src)
+	}
+	return CopyStrategy, fmt.Errorf("unknown copy strategy %q", CopyStrategy)
+}
+
+// rewind undoes a partial copy so that another strategy can be tried.
+func rewind(dst, src *os.File) error {
+	if err := dst.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := src.Seek(0, io.SeekStart)
+	return err
+}
+
+// SameFilesystem reports whether the files at a and b are known to be on the
+// same filesystem, where cloning and linking between them can work.
+func SameFilesystem(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	ak, ok := keyFor(ai)
+	if !ok {
+		return false
+	}
+	bk, ok := keyFor(bi)
+	return ok && ak.Dev == bk.Dev
+}
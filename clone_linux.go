@@ -0,0 +1,29 @@
+package arrange
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func cloneFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+// copyRange copies src to dst with copy_file_range, failing rather than
+// copying through userspace where the kernel or filesystem can't, so that
+// copyFile's fallback is counted as the Stream it is.
+func copyRange(dst, src *os.File) error {
+	for {
+		n, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, 1<<30, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
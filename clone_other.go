@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package arrange
+
+import "os"
+
+func cloneFile(dst, src *os.File) error {
+	return errUnsupported
+}
+
+func copyRange(dst, src *os.File) error {
+	return errUnsupported
+}
@@ -4,44 +4,216 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"sync"
+	"time"
 
 	"mcquay.me/arrange"
 )
 
 func arr(indir, outdir string) error {
+	if *dryRun {
+		return arrPlan(indir, outdir)
+	}
 	if err := arrange.PrepOutput(outdir); err != nil {
 		return fmt.Errorf("problem creating directory structure: %v", err)
 	}
+	if n, err := arrange.Sweep(outdir); err != nil {
+		return fmt.Errorf("problem sweeping temporary files: %v", err)
+	} else if n > 0 {
+		log.Printf("removed %d stale temporary files", n)
+	}
+
+	cache, err := openCache(outdir)
+	if err != nil {
+		return err
+	}
 
 	work := arrange.Source(indir)
 	streams := []<-chan arrange.Media{}
 
+	if cache != nil {
+		var hits <-chan arrange.Media
+		hits, work = cache.Split(work)
+		streams = append(streams, hits)
+	}
+
 	workers := runtime.NumCPU()
 	if *cores != 0 {
 		workers = *cores
 	}
 
+	// Copying while parsing saves reading each file twice, but is wasted
+	// effort when originals can be linked (in move mode) or cloned into
+	// place instead.
+	stage := *mode != "move" && arrange.CopyStrategy != arrange.Clone && arrange.CopyStrategy != arrange.CopyRange
+	if stage && arrange.CopyStrategy == arrange.Auto {
+		stage = !arrange.SameFilesystem(indir, outdir)
+	}
+
+	manifest, err := arrange.CreateManifest(outdir, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// files that can't be parsed are recorded alongside those placed
+	sk := &skips{manifest: manifest}
 	for w := 0; w < workers; w++ {
-		streams = append(streams, arrange.Parse(work))
+		var s <-chan arrange.Media
+		if !stage {
+			s = arrange.ParseReport(work, sk.report)
+		} else {
+			s = arrange.StageReport(work, outdir, sk.report)
+		}
+		if cache != nil {
+			s = cache.Remember(s)
+		}
+		streams = append(streams, s)
 	}
 
 	st := stats{}
-	for err := range arrange.Move(arrange.Merge(streams), outdir) {
+	for r := range arrange.Place(arrange.Merge(streams), outdir, *mode == "move") {
+		if err := manifest.Write(r); err != nil {
+			log.Printf("problem recording %q: %v", r.Media.Path, err)
+		}
 		st.total++
-		if err != nil {
-			switch err.(type) {
+		if r.Err != nil {
+			switch r.Err.(type) {
 			case arrange.Dup:
 				st.dupes++
 			default:
-				log.Printf("%+v", err)
+				log.Printf("%+v", r.Err)
 			}
-		} else {
-			st.moved++
+			continue
+		}
+		st.moved++
+		switch r.Strategy {
+		case arrange.Clone, arrange.Linked:
+			st.cloned++
+		default:
+			st.copied++
 		}
 	}
 
+	st.skipped = sk.count()
+	st.total += st.skipped
+	log.Printf("dupes: %+v", st.dupes)
+	log.Printf("moved: %+v (cloned or linked: %d, copied: %d)", st.moved, st.cloned, st.copied)
+	log.Printf("skipped: %+v", st.skipped)
+	log.Printf("total: %+v", st.total)
+
+	if err := manifest.Close(); err != nil {
+		return fmt.Errorf("problem writing manifest: %v", err)
+	}
+	log.Printf("manifest: %s", manifest.Name())
+
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			return fmt.Errorf("problem saving cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// arrPlan prints what arr would do, without touching outdir.
+func arrPlan(indir, outdir string) error {
+	if err := arrange.CheckConfig(outdir); err != nil {
+		return err
+	}
+
+	cache, err := openCache(outdir)
+	if err != nil {
+		return err
+	}
+
+	work := arrange.Source(indir)
+	streams := []<-chan arrange.Media{}
+
+	if cache != nil {
+		var hits <-chan arrange.Media
+		hits, work = cache.Split(work)
+		streams = append(streams, hits)
+	}
+
+	workers := runtime.NumCPU()
+	if *cores != 0 {
+		workers = *cores
+	}
+
+	sk := &skips{}
+	for w := 0; w < workers; w++ {
+		streams = append(streams, arrange.ParseReport(work, sk.report))
+	}
+
+	st := stats{}
+	p := arrange.NewPlanner(outdir)
+	p.Take = *mode == "move"
+	for m := range arrange.Merge(streams) {
+		st.total++
+		r := p.Plan(m)
+		if r.Err != nil {
+			switch r.Err.(type) {
+			case arrange.Dup:
+				st.dupes++
+				if r.Removed {
+					fmt.Printf("remove %q (dup of %q)\n", m.Path, r.Content)
+				} else {
+					fmt.Printf("dup %q (%q)\n", m.Path, r.Content)
+				}
+			default:
+				log.Printf("%+v", r.Err)
+			}
+			continue
+		}
+		st.moved++
+		fmt.Printf("%s %q -> %q\n", *mode, m.Path, r.Content)
+		fmt.Printf("link %q -> %q\n", r.Content, r.Date)
+		if r.Sidecar != "" {
+			fmt.Printf("%s %q -> %q\n", *mode, m.Sidecar, r.Sidecar)
+		}
+	}
+
+	st.skipped = sk.count()
+	st.total += st.skipped
 	log.Printf("dupes: %+v", st.dupes)
 	log.Printf("moved: %+v", st.moved)
+	log.Printf("skipped: %+v", st.skipped)
 	log.Printf("total: %+v", st.total)
 	return nil
 }
+
+// logFailure logs the Result for a file that couldn't be parsed.
+func logFailure(r arrange.Result) {
+	switch r.Err.(type) {
+	case arrange.NotMedia:
+		log.Printf("%+v", r.Err)
+	default:
+		log.Printf("parse error: %+v", r.Err)
+	}
+}
+
+// skips counts the files that couldn't be parsed, and records them in
+// manifest if it is set. report may be called by many workers at once.
+type skips struct {
+	manifest *arrange.Manifest
+
+	mu sync.Mutex
+	n  int
+}
+
+func (sk *skips) report(r arrange.Result) {
+	logFailure(r)
+	if sk.manifest != nil {
+		if err := sk.manifest.Write(r); err != nil {
+			log.Printf("problem recording %q: %v", r.Media.Path, err)
+		}
+	}
+	sk.mu.Lock()
+	sk.n++
+	sk.mu.Unlock()
+}
+
+func (sk *skips) count() int {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	return sk.n
+}
@@ -16,40 +16,86 @@ func clean(dir string) error {
 	if _, err := os.Stat(dateDir); os.IsNotExist(err) {
 		return fmt.Errorf("couldn't find 'date' dir in %q", dir)
 	}
+	c, err := arrange.ReadConfig(dir)
+	if err != nil {
+		return err
+	}
+
+	cache, err := openCache(dir)
+	if err != nil {
+		return err
+	}
 
 	work := arrange.Source(dateDir)
 	streams := []<-chan arrange.Media{}
 	errs := []<-chan error{}
 
+	if cache != nil {
+		var hits <-chan arrange.Media
+		hits, work = cache.Split(work)
+		s, e := arrange.MissingLink(hits, dir)
+		streams = append(streams, s)
+		errs = append(errs, e)
+	}
+
 	workers := runtime.NumCPU()
 	if *cores != 0 {
 		workers = *cores
 	}
 
+	sk := &skips{}
 	for w := 0; w < workers; w++ {
-		s, e := arrange.MissingLink(arrange.Parse(work), dir)
+		p := arrange.ParseReport(work, sk.report)
+		if cache != nil {
+			p = cache.Remember(p)
+		}
+		s, e := arrange.MissingLink(p, dir)
 		streams = append(streams, s)
 		errs = append(errs, e)
 	}
 
-	var err error
+	drained := make(chan bool)
 	go func() {
 		for e := range eMerge(errs) {
 			log.Printf("%+v", e)
 			err = fmt.Errorf("%v, %v", err, e)
 		}
+		close(drained)
 	}()
 
+	relinked, failed := 0, 0
 	for m := range arrange.Merge(streams) {
+		relinked++
+		if *dryRun {
+			fmt.Printf("replace %q with %s link to %q\n", m.Path, arrange.Links, m.Content(dir))
+			continue
+		}
 		log.Printf("%q > %q", m.Path, m.Content(dir))
-		if err := os.Remove(m.Path); err != nil {
+		if err := arrange.Relink(m.Path, m.Content(dir)); err != nil {
 			log.Printf("%+v", err)
+			failed++
 		}
-		if err := os.Link(m.Content(dir), m.Path); err != nil {
-			log.Printf("%+v", err)
+	}
+
+	<-drained
+	log.Printf("relinked: %+v", relinked)
+	log.Printf("skipped: %+v", sk.count())
+
+	if c.Links != arrange.Links && !*dryRun {
+		if err != nil || failed > 0 {
+			return fmt.Errorf("%q was not fully converted to %s links, and is still recorded as %s", dir, arrange.Links, c.Links)
+		}
+		c.Links = arrange.Links
+		if err := arrange.WriteConfig(dir, c); err != nil {
+			return err
 		}
 	}
 
+	if cache != nil && !*dryRun {
+		if err := cache.Save(); err != nil {
+			return fmt.Errorf("problem saving cache: %v", err)
+		}
+	}
 	return err
 }
 
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"mcquay.me/arrange"
+)
+
+// fsck reports where root's content and date trees disagree, and with repair
+// set fixes what it can: dangling date entries are relinked, strays are
+// quarantined, and orphans are added back to the date tree. Nothing is hashed,
+// so blobs whose contents don't match their address are left to verify.
+func fsck(root string, repair bool) error {
+	if err := useConfig(root); err != nil {
+		return err
+	}
+
+	problems, failed := 0, 0
+	orphans := []string{}
+	for err := range arrange.Fsck(root) {
+		problems++
+		fmt.Printf("%v\n", err)
+		if !repair {
+			continue
+		}
+		var rerr error
+		switch e := err.(type) {
+		case arrange.Dangling:
+			rerr = arrange.RepairDangling(e.Path, root)
+		case arrange.BadAddress:
+			rerr = arrange.Quarantine(e.Path, root)
+		case arrange.Orphan:
+			orphans = append(orphans, e.Path)
+			continue
+		default:
+			return err
+		}
+		if rerr != nil {
+			log.Printf("could not repair: %v", rerr)
+			failed++
+		}
+	}
+
+	// Relinking dangling entries can claim orphans, so check again before
+	// adopting them.
+	if len(orphans) > 0 {
+		for err := range arrange.Fsck(root) {
+			e, ok := err.(arrange.Orphan)
+			if !ok {
+				continue
+			}
+			if err := arrange.AdoptOrphan(e.Path, root); err != nil {
+				log.Printf("could not repair: %v", err)
+				failed++
+			}
+		}
+	}
+
+	log.Printf("problems: %+v", problems)
+	switch {
+	case problems > 0 && !repair:
+		return fmt.Errorf("%d problems found", problems)
+	case failed > 0:
+		return fmt.Errorf("%d of %d problems could not be repaired", failed, problems)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"mcquay.me/arrange"
+)
+
+// gc removes (or trashes) content that has had no date entry for at least
+// grace, and remembers the rest for next time.
+func gc(root string, grace time.Duration, trash bool) error {
+	if err := useConfig(root); err != nil {
+		return err
+	}
+	gs, err := arrange.FindGarbage(root)
+	if err != nil {
+		return err
+	}
+
+	action := "remove"
+	if trash {
+		action = "trash"
+	}
+	kept := []arrange.Garbage{}
+	collected, failed := 0, 0
+	for _, g := range gs {
+		if age := time.Since(g.Since); age < grace {
+			fmt.Printf("keep %q (unreferenced for %v)\n", g.Path, age.Round(time.Second))
+			kept = append(kept, g)
+			continue
+		}
+		fmt.Printf("%s %q\n", action, g.Path)
+		if *dryRun {
+			continue
+		}
+		if err := arrange.Discard(g.Path, root, trash); err != nil {
+			log.Printf("%+v", err)
+			kept = append(kept, g)
+			failed++
+			continue
+		}
+		collected++
+	}
+
+	log.Printf("collected: %+v", collected)
+	log.Printf("kept: %+v", len(kept)-failed)
+	if *dryRun {
+		return nil
+	}
+	if err := arrange.SaveGarbage(root, kept); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d unreferenced blobs could not be collected", failed)
+	}
+	return nil
+}
@@ -5,20 +5,53 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
+
+	"mcquay.me/arrange"
 )
 
-const usage = "am <arr|clean|meta> [flags]"
-const arrUsage = "am arr [-h|-cores=N] <in> <out>"
-const cleanUsage = "am clean [-h|-cores=N] <directory>"
-const metaUsage = "am meta [-h|-cores=N] <file0> <file1> ... <fileN>"
+const usage = "am <arr|clean|meta|migrate-hash|verify|fsck|gc|undo> [flags]"
+const arrUsage = "am arr [-h|-cores=N|-sniff|-hash=ALGO|-links=hard|symbolic|-template=TEMPLATE|-zone=ZONE|-skew=RULES|-time=SOURCES|-names=PATTERNS|-no-cache|-rebuild-cache|-dry-run|-mode=copy|move|-copy=auto|clone|range|stream] <in> <out>"
+const cleanUsage = "am clean [-h|-cores=N|-sniff|-links=hard|symbolic|-no-cache|-rebuild-cache|-dry-run] <directory>"
+const metaUsage = "am meta [-h|-cores=N|-sniff|-skew=RULES|-time=SOURCES|-names=PATTERNS] <file0> <file1> ... <fileN>"
+const migrateUsage = "am migrate-hash [-h|-cores=N] -hash=ALGO <directory>"
+const fsckUsage = "am fsck [-h|-repair] <directory>\n\nfsck checks names and links, not contents: a blob under the wrong prefix directory\nis named for a hash it doesn't have, which only am verify can tell."
+const gcUsage = "am gc [-h|-grace=DURATION|-trash|-dry-run] <directory>"
+const undoUsage = "am undo [-h] <root>/imports/<manifest>.jsonl"
+const verifyUsage = "am verify [-h|-cores=N|-sample=PERCENT] <directory>"
 
 type stats struct {
 	total int
 	dupes int
 	moved int
+
+	// cloned and copied count how moved files got into the content store.
+	cloned int
+	copied int
+
+	// skipped counts files that couldn't be parsed.
+	skipped int
 }
 
 var cores = flag.Int("cores", 0, "how many threads to use")
+var sniff = flag.Bool("sniff", false, "detect file types from content instead of extension")
+var mode = flag.String("mode", "copy", "copy or move files into the output tree")
+var dryRun = flag.Bool("dry-run", false, "print what arr, clean or gc would do without doing it")
+var copyStrategy = flag.String("copy", "auto", "how to copy files into the store: auto, clone, range or stream")
+var links = flag.String("links", "", "link date/ to content/ with hard or symbolic links; clean converts an existing tree (default hard)")
+var samplePercent = flag.Float64("sample", 100, "percentage of content for verify to check")
+var repair = flag.Bool("repair", false, "have fsck fix the problems it finds")
+var grace = flag.Duration("grace", 30*24*time.Hour, "how long gc leaves unreferenced content alone")
+var trash = flag.Bool("trash", false, "have gc move unreferenced content to trash/ instead of removing it")
+var dateTemplate = flag.String("template", "", fmt.Sprintf("text/template naming files in a new tree's date/ (default %q)", arrange.DefaultTemplate))
+var dateZone = flag.String("zone", "", fmt.Sprintf("zone to lay out a new tree's date/ in: %s (each file's own), or a name like UTC or Europe/Paris (default %s)", arrange.CaptureZone, arrange.CaptureZone))
+var timeSources = flag.String("time", "", fmt.Sprintf("comma-separated sources for arr and meta to take times from, best first (default %s)", strings.Join(arrange.TimePrecedence, ",")))
+var namePatterns = flag.String("names", "", "file of regular expressions, one per line, that find dates in file names for arr and meta")
+var skewRules = flag.String("skew", "", "JSON file of per-camera clock corrections for arr and meta")
+var noCache = flag.Bool("no-cache", false, "neither use nor update the hash cache")
+var rebuildCache = flag.Bool("rebuild-cache", false, "ignore and replace the hash cache")
+var hash = flag.String("hash", "", fmt.Sprintf("content hash for a new output tree %v (default md5)", arrange.Hashes()))
 
 func main() {
 	if len(os.Args) < 2 {
@@ -30,6 +63,7 @@ func main() {
 
 	flag.Parse()
 	log.SetFlags(log.Lshortfile)
+	arrange.Sniff = *sniff
 
 	switch sub {
 	case "ar", "arr", "arrange":
@@ -39,6 +73,25 @@ func main() {
 			os.Exit(1)
 		}
 		in, out := args[0], args[1]
+		if *mode != "copy" && *mode != "move" {
+			fmt.Fprintf(os.Stderr, "%s\n", arrUsage)
+			os.Exit(1)
+		}
+		switch s := arrange.Strategy(*copyStrategy); s {
+		case arrange.Auto, arrange.Clone, arrange.CopyRange, arrange.Stream:
+			arrange.CopyStrategy = s
+		default:
+			fmt.Fprintf(os.Stderr, "%s\n", arrUsage)
+			os.Exit(1)
+		}
+		if err := useConfig(out); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if err := useParseFlags(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
 		if err := arr(in, out); err != nil {
 			fmt.Fprintf(os.Stderr, "problem arranging media: %v\n", err)
 			os.Exit(1)
@@ -50,6 +103,10 @@ func main() {
 			os.Exit(1)
 		}
 		dir := args[0]
+		if err := useConfig(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
 		if err := clean(dir); err != nil {
 			fmt.Fprintf(os.Stderr, "problem cleaning: %v\n", err)
 			os.Exit(1)
@@ -60,10 +117,143 @@ func main() {
 			fmt.Fprintf(os.Stderr, "%s\n", metaUsage)
 			os.Exit(1)
 		}
+		if err := useParseFlags(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
 		meta(args)
+	case "migrate-hash":
+		args := flag.Args()
+		if len(args) != 1 || *hash == "" {
+			fmt.Fprintf(os.Stderr, "%s\n", migrateUsage)
+			os.Exit(1)
+		}
+		dir := args[0]
+		if err := migrateHash(dir, *hash); err != nil {
+			fmt.Fprintf(os.Stderr, "problem migrating hash: %v\n", err)
+			os.Exit(1)
+		}
+	case "verify":
+		args := flag.Args()
+		if len(args) != 1 || *samplePercent <= 0 || *samplePercent > 100 {
+			fmt.Fprintf(os.Stderr, "%s\n", verifyUsage)
+			os.Exit(1)
+		}
+		if err := verify(args[0], *samplePercent); err != nil {
+			fmt.Fprintf(os.Stderr, "problem verifying: %v\n", err)
+			os.Exit(1)
+		}
+	case "fsck":
+		args := flag.Args()
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "%s\n", fsckUsage)
+			os.Exit(1)
+		}
+		if err := fsck(args[0], *repair); err != nil {
+			fmt.Fprintf(os.Stderr, "problem checking tree: %v\n", err)
+			os.Exit(1)
+		}
+	case "gc":
+		args := flag.Args()
+		if len(args) != 1 || *grace < 0 {
+			fmt.Fprintf(os.Stderr, "%s\n", gcUsage)
+			os.Exit(1)
+		}
+		if err := gc(args[0], *grace, *trash); err != nil {
+			fmt.Fprintf(os.Stderr, "problem collecting garbage: %v\n", err)
+			os.Exit(1)
+		}
+	case "undo":
+		args := flag.Args()
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "%s\n", undoUsage)
+			os.Exit(1)
+		}
+		if err := undo(args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "problem undoing import: %v\n", err)
+			os.Exit(1)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "%s\n", usage)
 		os.Exit(1)
 	}
 
 }
+
+// useConfig selects the hash, kind of link, date template and zone from the
+// -hash, -links, -template and -zone flags, or else the ones recorded in the
+// tree at root.
+func useConfig(root string) error {
+	c, err := arrange.ReadConfig(root)
+	if err != nil {
+		return err
+	}
+	arrange.HashAlgorithm = c.Hash
+	if *hash != "" {
+		arrange.HashAlgorithm = *hash
+	}
+	arrange.Links = c.Links
+	switch *links {
+	case "":
+	case "hard", "symbolic":
+		arrange.Links = *links
+	default:
+		return fmt.Errorf("unsupported link kind %q (want hard or symbolic)", *links)
+	}
+	arrange.DateTemplate = c.Template
+	if *dateTemplate != "" {
+		arrange.DateTemplate = *dateTemplate
+	}
+	arrange.DateZone = c.Zone
+	if *dateZone != "" {
+		arrange.DateZone = *dateZone
+	}
+	return nil
+}
+
+// useParseFlags applies the -time, -names and -skew flags, which change the
+// times arr and meta find.
+func useParseFlags() error {
+	if *timeSources != "" {
+		ts := strings.Split(*timeSources, ",")
+		if err := arrange.CheckPrecedence(ts); err != nil {
+			return err
+		}
+		arrange.TimePrecedence = ts
+	}
+	if *namePatterns != "" {
+		res, err := arrange.LoadNamePatterns(*namePatterns)
+		if err != nil {
+			return err
+		}
+		arrange.NamePatterns = res
+	}
+	if *skewRules != "" {
+		skews, err := arrange.LoadSkews(*skewRules)
+		if err != nil {
+			return err
+		}
+		arrange.Skews = skews
+	}
+	return nil
+}
+
+// openCache returns the hash cache for the tree at root, as directed by the
+// -no-cache and -rebuild-cache flags. It returns nil if the cache is not to be
+// used.
+func openCache(root string) (*arrange.Cache, error) {
+	if *noCache {
+		return nil, nil
+	}
+	if *rebuildCache {
+		return arrange.NewCache(arrange.CachePath(root)), nil
+	}
+	c, err := arrange.OpenCache(arrange.CachePath(root))
+	if err != nil {
+		return nil, fmt.Errorf("%v (try -rebuild-cache)", err)
+	}
+	if n := c.Prune(root); n > 0 {
+		log.Printf("forgot %d cached files no longer in the store", n)
+	}
+	return c, nil
+}
@@ -37,6 +37,14 @@ func meta(files []string) {
 		close(fc)
 	}()
 	for f := range fc {
-		fmt.Printf("%+v: %v\n", f.Time, f.Path)
+		source := f.TimeSource
+		if f.Skew != 0 {
+			source = fmt.Sprintf("%s, corrected by %v", source, f.Skew)
+		}
+		if f.Misnamed != "" {
+			fmt.Printf("%+v (%s): %v (really %v)\n", f.Time, source, f.Path, f.Extension)
+			continue
+		}
+		fmt.Printf("%+v (%s): %v\n", f.Time, source, f.Path)
 	}
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+
+	"mcquay.me/arrange"
+)
+
+func migrateHash(root, to string) error {
+	c, err := arrange.ReadConfig(root)
+	if err != nil {
+		return err
+	}
+	if c.Hash == to {
+		return fmt.Errorf("%q is already addressed with %s", root, to)
+	}
+	arrange.HashAlgorithm = to
+	arrange.Links = c.Links
+
+	work := arrange.Blobs(root)
+	errs := []<-chan error{}
+
+	workers := runtime.NumCPU()
+	if *cores != 0 {
+		workers = *cores
+	}
+
+	for w := 0; w < workers; w++ {
+		errs = append(errs, arrange.Readdress(work, root))
+	}
+
+	failed := 0
+	for err := range eMerge(errs) {
+		if err != nil {
+			log.Printf("%+v", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d blobs could not be readdressed; %q is still recorded as %s", failed, root, c.Hash)
+	}
+
+	c.Hash = to
+	if err := arrange.WriteConfig(root, c); err != nil {
+		return err
+	}
+	if c.Links == "symbolic" {
+		return arrange.ResolveLinks(root)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"mcquay.me/arrange"
+)
+
+// undo reverses the arr run recorded in the manifest at path, and renames the
+// manifest so that it isn't undone twice.
+func undo(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if filepath.Base(dir) != arrange.ManifestDir {
+		return fmt.Errorf("%q is not in a tree's %s directory", path, arrange.ManifestDir)
+	}
+	root := filepath.Dir(dir)
+	if err := useConfig(root); err != nil {
+		return err
+	}
+
+	if err := arrange.Undo(path, root); err != nil {
+		return err
+	}
+	log.Printf("undone: %s", path)
+	return os.Rename(path, path+".undone")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"mcquay.me/arrange"
+)
+
+// verify rehashes percent of the blobs in root's content store, and reports
+// any that don't match their addresses.
+func verify(root string, percent float64) error {
+	c, err := arrange.ReadConfig(root)
+	if err != nil {
+		return err
+	}
+	arrange.HashAlgorithm = c.Hash
+
+	work := arrange.Blobs(root)
+	if percent < 100 {
+		work = sample(work, percent)
+	}
+	errs := []<-chan error{}
+
+	workers := runtime.NumCPU()
+	if *cores != 0 {
+		workers = *cores
+	}
+
+	for w := 0; w < workers; w++ {
+		errs = append(errs, arrange.Verify(work, root))
+	}
+
+	// the manifests say how big blobs were when they were added, which tells
+	// truncated ones from corrupt ones; they are only read if needed
+	var sizes map[string]int64
+	checked, bad := 0, 0
+	for err := range eMerge(errs) {
+		checked++
+		if err == nil {
+			continue
+		}
+		bad++
+		if e, ok := err.(arrange.Corrupt); ok {
+			if sizes == nil {
+				var merr error
+				if sizes, merr = arrange.BlobSizes(root); merr != nil {
+					log.Printf("problem reading manifests: %v", merr)
+					sizes = map[string]int64{}
+				}
+			}
+			name := filepath.Base(e.Path)
+			sum := filepath.Base(filepath.Dir(e.Path)) + strings.TrimSuffix(name, filepath.Ext(name))
+			if want, ok := sizes[sum]; ok {
+				if fi, serr := os.Stat(e.Path); serr == nil && fi.Size() < want {
+					err = arrange.Truncated{Path: e.Path, Size: fi.Size(), Want: want}
+				}
+			}
+		}
+		fmt.Printf("%v\n", err)
+	}
+
+	log.Printf("checked: %+v", checked)
+	log.Printf("damaged: %+v", bad)
+	if bad > 0 {
+		return fmt.Errorf("%d of %d blobs checked are damaged", bad, checked)
+	}
+	return nil
+}
+
+// sample passes on about percent of the paths on input chan.
+func sample(in <-chan string, percent float64) <-chan string {
+	out := make(chan string)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	go func() {
+		for p := range in {
+			if r.Float64()*100 < percent {
+				out <- p
+			}
+		}
+		close(out)
+	}()
+	return out
+}
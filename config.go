@@ -0,0 +1,91 @@
+package arrange
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const configName = "arrange.json"
+
+// Config records how an output tree is laid out, so that later runs against
+// the same root agree with the one that created it.
+type Config struct {
+	// Hash is the algorithm used to content-address files in content/.
+	Hash string `json:"hash"`
+
+	// Links is how date/ refers to content/; see Links.
+	Links string `json:"links,omitempty"`
+
+	// Template names entries in date/; see DateTemplate.
+	Template string `json:"template,omitempty"`
+
+	// Zone is the zone date/ is laid out in; see DateZone.
+	Zone string `json:"zone,omitempty"`
+}
+
+// ReadConfig returns the Config stored in root. Trees that predate Config are
+// reported with their implicit settings.
+func ReadConfig(root string) (Config, error) {
+	c := Config{Hash: "md5", Links: "hard", Template: DefaultTemplate, Zone: CaptureZone}
+	b, err := ioutil.ReadFile(filepath.Join(root, configName))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("problem reading config: %v", err)
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("problem parsing config %q: %v", filepath.Join(root, configName), err)
+	}
+	if c.Links == "" {
+		c.Links = "hard"
+	}
+	if c.Template == "" {
+		c.Template = DefaultTemplate
+	}
+	if c.Zone == "" {
+		c.Zone = CaptureZone
+	}
+	return c, nil
+}
+
+// WriteConfig stores c in root.
+func WriteConfig(root string, c Config) error {
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(root, configName+".tmp")
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("problem writing config: %v", err)
+	}
+	return os.Rename(tmp, filepath.Join(root, configName))
+}
+
+// CheckConfig verifies that the package settings agree with those recorded
+// in root. Anything agrees with a tree that has no content yet.
+func CheckConfig(root string) error {
+	if _, err := os.Stat(filepath.Join(root, "content")); os.IsNotExist(err) {
+		return nil
+	}
+	c, err := ReadConfig(root)
+	if err != nil {
+		return err
+	}
+	if c.Hash != HashAlgorithm {
+		return fmt.Errorf("%q is addressed with %s, not %s", root, c.Hash, HashAlgorithm)
+	}
+	if c.Links != Links {
+		return fmt.Errorf("%q is linked with %s links, not %s", root, c.Links, Links)
+	}
+	if c.Template != DateTemplate {
+		return fmt.Errorf("%q is laid out with date template %q, not %q", root, c.Template, DateTemplate)
+	}
+	if c.Zone != DateZone {
+		return fmt.Errorf("%q is laid out in zone %q, not %q", root, c.Zone, DateZone)
+	}
+	return nil
+}
@@ -1,6 +1,12 @@
 package arrange
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrFormat is returned by a Parser when a file is not in its format.
+var ErrFormat = errors.New("unrecognized format")
 
 // NotMedia is for unkown filetypes.
 type NotMedia struct {
@@ -19,3 +25,67 @@ type Dup struct {
 func (d Dup) Error() string {
 	return fmt.Sprintf("dup: %q", d.Path)
 }
+
+// Collision indicates a file with the same hash as, but different contents
+// from, a file already in the content store.
+type Collision struct {
+	Path    string
+	Content string
+}
+
+func (c Collision) Error() string {
+	return fmt.Sprintf("collision: %q has the hash of, but not the contents of, %q", c.Path, c.Content)
+}
+
+// BadAddress indicates a file in the content store whose name is not a
+// content address.
+type BadAddress struct {
+	Path string
+}
+
+func (b BadAddress) Error() string {
+	return fmt.Sprintf("bad address: %q is not named for a %s hash", b.Path, HashAlgorithm)
+}
+
+// Corrupt indicates a content file that no longer hashes to its address.
+type Corrupt struct {
+	Path string
+	Hash string
+}
+
+func (c Corrupt) Error() string {
+	return fmt.Sprintf("corrupt: %q hashes to %s", c.Path, c.Hash)
+}
+
+// Truncated indicates a content file that is shorter than it once was.
+type Truncated struct {
+	Path string
+	Size int64
+	Want int64
+}
+
+func (t Truncated) Error() string {
+	if t.Want < 0 {
+		return fmt.Sprintf("truncated: %q is empty", t.Path)
+	}
+	return fmt.Sprintf("truncated: %q is %d bytes, not %d", t.Path, t.Size, t.Want)
+}
+
+// Orphan indicates a content file that nothing in the date tree links to.
+type Orphan struct {
+	Path string
+}
+
+func (o Orphan) Error() string {
+	return fmt.Sprintf("orphan: %q is not in the date tree", o.Path)
+}
+
+// Dangling indicates a file in the date tree that isn't a link to anything in
+// the content store.
+type Dangling struct {
+	Path string
+}
+
+func (d Dangling) Error() string {
+	return fmt.Sprintf("dangling: %q is not linked to the content store", d.Path)
+}
@@ -0,0 +1,134 @@
+package arrange
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// builtinNamePatterns match the names that common cameras, phones and
+// messengers give their files.
+var builtinNamePatterns = []*regexp.Regexp{
+	// IMG_20190704_153012.jpg, PXL_20190704_153012345.jpg,
+	// VID_20190704_153012.mp4, Screenshot_20190704-153012.png
+	regexp.MustCompile(`(?:^|[^0-9])(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})[_-](?P<hour>\d{2})(?P<minute>\d{2})(?P<second>\d{2})`),
+	// Screenshot 2019-07-04 at 15.30.12.png, 2019-07-04 15.30.12.jpg
+	regexp.MustCompile(`(?:^|[^0-9])(?P<year>\d{4})-(?P<month>\d{2})-(?P<day>\d{2})[ _T](?:at )?(?P<hour>\d{2})[.:\-](?P<minute>\d{2})[.:\-](?P<second>\d{2})`),
+	// IMG-20190704-WA0003.jpg, VID-20190704-WA0003.mp4
+	regexp.MustCompile(`(?:^|[^0-9])(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})-WA\d+`),
+	// 2019-07-04.jpg, Photo 2019-07-04 (2).jpg
+	regexp.MustCompile(`(?:^|[^0-9])(?P<year>\d{4})-(?P<month>\d{2})-(?P<day>\d{2})(?:[^0-9]|$)`),
+}
+
+// NamePatterns are regular expressions that ParseFile tries on file names,
+// before the built-in ones, for TimeFilename. They must have year, month and
+// day named groups, and may have hour, minute and second ones; see
+// CompileNamePattern.
+var NamePatterns []*regexp.Regexp
+
+// CompileNamePattern compiles expr for NamePatterns.
+func CompileNamePattern(expr string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("bad name pattern: %v", err)
+	}
+	groups := map[string]bool{}
+	for _, n := range re.SubexpNames() {
+		groups[n] = true
+	}
+	for _, n := range []string{"year", "month", "day"} {
+		if !groups[n] {
+			return nil, fmt.Errorf("name pattern %q has no %s group", expr, n)
+		}
+	}
+	return re, nil
+}
+
+// LoadNamePatterns reads NamePatterns from the file at path, one per line.
+// Blank lines and lines starting with # are skipped.
+func LoadNamePatterns(path string) ([]*regexp.Regexp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading name patterns: %v", err)
+	}
+	defer f.Close()
+	var res []*regexp.Regexp
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := CompileNamePattern(line)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("problem reading name patterns: %v", err)
+	}
+	return res, nil
+}
+
+// nameTime returns the time in the name of the file at path, read as local
+// time, according to the first of NamePatterns or the built-in patterns that
+// gives a valid one.
+func nameTime(path string) (time.Time, bool) {
+	name := filepath.Base(path)
+	for _, patterns := range [][]*regexp.Regexp{NamePatterns, builtinNamePatterns} {
+		for _, re := range patterns {
+			if t, ok := matchTime(re, name); ok {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// matchTime returns the time that re finds in name.
+func matchTime(re *regexp.Regexp, name string) (time.Time, bool) {
+	m := re.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, false
+	}
+	v := map[string]int{}
+	for i, n := range re.SubexpNames() {
+		if n == "" || m[i] == "" {
+			continue
+		}
+		x, err := strconv.Atoi(m[i])
+		if err != nil {
+			return time.Time{}, false
+		}
+		v[n] = x
+	}
+	if v["year"] < 1900 || v["year"] > 2100 {
+		return time.Time{}, false
+	}
+	t := time.Date(v["year"], time.Month(v["month"]), v["day"], v["hour"], v["minute"], v["second"], 0, time.Local)
+	// reject anything time.Date had to normalize, like a 13th month
+	if t.Year() != v["year"] || int(t.Month()) != v["month"] || t.Day() != v["day"] ||
+		t.Hour() != v["hour"] || t.Minute() != v["minute"] || t.Second() != v["second"] {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// nameDigest summarizes NamePatterns for settings.
+func nameDigest() string {
+	if len(NamePatterns) == 0 {
+		return "none"
+	}
+	h := sha1.New()
+	for _, re := range NamePatterns {
+		fmt.Fprintln(h, re.String())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
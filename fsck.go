@@ -0,0 +1,209 @@
+package arrange
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// quarantineDir is where Quarantine puts files, relative to a tree's root.
+const quarantineDir = "quarantine"
+
+// inode identifies a file regardless of its name.
+type inode struct {
+	dev, ino uint64
+}
+
+func inodeOf(fi os.FileInfo) (inode, bool) {
+	k, ok := keyFor(fi)
+	return inode{k.Dev, k.Ino}, ok
+}
+
+// Fsck checks that the content and date trees under root agree. It sends a
+// BadAddress for each stray file in content/ whose name is not a content
+// address, without reading it; a blob under the wrong prefix directory is
+// left to VerifyFile. It sends a Dangling for each date entry that is not a
+// link to the store, and then an Orphan for each blob with no date entry.
+// Sidecars, temp files and the likes of .DS_Store are not entries; see
+// isEntry. Entries are judged by what they link to rather than by how, so
+// hardlinks and symlinks are both understood; see MissingLink for that.
+func Fsck(root string) <-chan error {
+	out := make(chan error)
+	go func() {
+		defer close(out)
+		blobs := map[inode]string{}
+		paths := map[string]bool{}
+		err := filepath.Walk(
+			filepath.Join(root, "content"),
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+					return nil
+				}
+				if _, ok := address(path, root); !ok || !info.Mode().IsRegular() {
+					out <- BadAddress{path}
+					return nil
+				}
+				id, ok := inodeOf(info)
+				if !ok {
+					return errors.New("fsck needs inode numbers, which this platform lacks")
+				}
+				blobs[id] = path
+				paths[path] = true
+				return nil
+			},
+		)
+		if err != nil {
+			out <- fmt.Errorf("problem checking content: %v", err)
+			return
+		}
+
+		referenced := map[string]bool{}
+		err = filepath.Walk(
+			filepath.Join(root, "date"),
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() || !isEntry(path) {
+					return nil
+				}
+				if info.Mode()&os.ModeSymlink != 0 {
+					target, err := os.Readlink(path)
+					if err != nil {
+						return err
+					}
+					if !filepath.IsAbs(target) {
+						target = filepath.Join(filepath.Dir(path), target)
+					}
+					if t := filepath.Clean(target); paths[t] {
+						referenced[t] = true
+						return nil
+					}
+				} else if id, ok := inodeOf(info); ok && blobs[id] != "" {
+					referenced[blobs[id]] = true
+					return nil
+				}
+				out <- Dangling{path}
+				return nil
+			},
+		)
+		if err != nil {
+			out <- fmt.Errorf("problem checking dates: %v", err)
+			return
+		}
+
+		for _, path := range blobs {
+			if !referenced[path] {
+				out <- Orphan{path}
+			}
+		}
+	}()
+	return out
+}
+
+// isEntry reports whether the file at path in a date tree is a date entry
+// rather than a sidecar, a temp file or something left by a file browser.
+func isEntry(path string) bool {
+	if isSidecar(path) || strings.HasPrefix(filepath.Base(path), tempPrefix) {
+		return false
+	}
+	return lookup(strings.ToLower(filepath.Ext(path))) != nil || Sniff
+}
+
+// Quarantine moves the file at path, which must be inside root, to the same
+// place under root's quarantine directory.
+func Quarantine(path, root string) error {
+	return moveAside(path, root, quarantineDir)
+}
+
+// moveAside moves the file at path, which must be inside root, to the same
+// place under root's dir.
+func moveAside(path, root, dir string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("%q is not inside %q", path, root)
+	}
+	dst := filepath.Join(root, dir, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if exists(dst) {
+		return fmt.Errorf("%q is already in %s", path, dir)
+	}
+	return os.Rename(path, dst)
+}
+
+// AdoptOrphan links the orphaned blob at path back into root's date tree, at
+// the time of its mtime, which Move sets to the capture time.
+func AdoptOrphan(path, root string) error {
+	sum, ok := address(path, root)
+	if !ok {
+		return BadAddress{path}
+	}
+	t, err := mtime(path)
+	if err != nil {
+		return err
+	}
+	m := Media{Path: path, Hash: sum, Extension: filepath.Ext(path), Time: t}
+	name, err := m.date(root, exists)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return fmt.Errorf("problem creating date directory: %v", err)
+	}
+	return link(path, name)
+}
+
+// RepairDangling links the dangling date entry at path to its content. A file
+// whose content isn't in the store yet is added to it first; a symlink to
+// nothing is quarantined, as there is nothing left to link it to.
+func RepairDangling(path, root string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	// src is what the entry holds: a symlink's target, which may be outside
+	// root, rather than the link itself.
+	src := path
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if src, err = filepath.EvalSymlinks(path); err != nil {
+			return Quarantine(path, root)
+		}
+		if fi, err = os.Stat(src); err != nil {
+			return Quarantine(path, root)
+		}
+	}
+
+	sum, err := HashFile(src)
+	if err != nil {
+		return err
+	}
+	m := Media{Path: src, Hash: sum, Extension: strings.ToLower(filepath.Ext(path))}
+	content := m.Content(root)
+	if !exists(content) {
+		tmp, err := linkTemp(src, filepath.Dir(content))
+		if err != nil {
+			if tmp, _, err = m.copy(filepath.Dir(content)); err != nil {
+				return err
+			}
+			if err := os.Chtimes(tmp, time.Now(), fi.ModTime()); err != nil {
+				os.Remove(tmp)
+				return err
+			}
+		}
+		if err := commit(tmp, content); err != nil {
+			os.Remove(tmp)
+			if !os.IsExist(err) {
+				return err
+			}
+		}
+	}
+	return Relink(path, content)
+}
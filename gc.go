@@ -0,0 +1,114 @@
+package arrange
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// garbageName is where FindGarbage's findings are remembered between runs,
+// relative to a tree's root.
+const garbageName = "garbage.json"
+
+// trashDir is where Discard moves content, relative to a tree's root.
+const trashDir = "trash"
+
+// Garbage is a content file that nothing in the date tree links to any more.
+type Garbage struct {
+	Path string
+	// Since is when the file was first found to be garbage.
+	Since time.Time
+}
+
+// FindGarbage returns the orphaned content files in root, with when each was
+// first found orphaned by a run whose findings were kept with SaveGarbage.
+// Neither hardlinks nor symlinks record when they were removed, so that is the
+// only way to give them a grace period.
+//
+// It refuses to guess while the date tree has dangling entries, as Fsck counts
+// them, since those may be copies of content that only looks orphaned; see
+// RepairDangling.
+func FindGarbage(root string) ([]Garbage, error) {
+	seen, err := readGarbage(root)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	gs := []Garbage{}
+	dangling := 0
+	for err := range Fsck(root) {
+		switch e := err.(type) {
+		case Orphan:
+			since, ok := seen[e.Path]
+			if !ok {
+				since = now
+			}
+			gs = append(gs, Garbage{Path: e.Path, Since: since})
+		case Dangling:
+			dangling++
+		case BadAddress:
+		default:
+			return nil, err
+		}
+	}
+	if dangling > 0 {
+		return nil, fmt.Errorf("%q has %d dangling date entries; repair them first", root, dangling)
+	}
+	sort.Slice(gs, func(i, j int) bool { return gs[i].Path < gs[j].Path })
+	return gs, nil
+}
+
+// readGarbage returns when each path in root's garbage file was first seen.
+func readGarbage(root string) (map[string]time.Time, error) {
+	seen := map[string]time.Time{}
+	b, err := ioutil.ReadFile(filepath.Join(root, garbageName))
+	if os.IsNotExist(err) {
+		return seen, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("problem reading garbage list: %v", err)
+	}
+	rel := map[string]time.Time{}
+	if err := json.Unmarshal(b, &rel); err != nil {
+		return nil, fmt.Errorf("problem parsing garbage list: %v", err)
+	}
+	for path, t := range rel {
+		seen[filepath.Join(root, path)] = t
+	}
+	return seen, nil
+}
+
+// SaveGarbage remembers gs in root for the next FindGarbage, replacing what
+// was remembered before.
+func SaveGarbage(root string, gs []Garbage) error {
+	rel := map[string]time.Time{}
+	for _, g := range gs {
+		r, err := filepath.Rel(root, g.Path)
+		if err != nil {
+			return err
+		}
+		rel[r] = g.Since
+	}
+	b, err := json.MarshalIndent(rel, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(root, garbageName+".tmp")
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("problem writing garbage list: %v", err)
+	}
+	return os.Rename(tmp, filepath.Join(root, garbageName))
+}
+
+// Discard removes the content file at path, or with trash set moves it to the
+// same place under root's trash directory.
+func Discard(path, root string, trash bool) error {
+	if trash {
+		return moveAside(path, root, trashDir)
+	}
+	return os.Remove(path)
+}
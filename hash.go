@@ -0,0 +1,188 @@
+package arrange
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// HashAlgorithm names the hash used to content-address media. It must agree
+// with the algorithm recorded in an output tree's Config.
+var HashAlgorithm = "md5"
+
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b-256": func() hash.Hash {
+		// only fails for bad keys
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+}
+
+// Hashes returns the names of the supported hash algorithms.
+func Hashes() []string {
+	r := []string{}
+	for name := range hashes {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+func newHash(name string) (hash.Hash, error) {
+	h, ok := hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q", name)
+	}
+	return h(), nil
+}
+
+// hashLen returns the length of hex-encoded sums made by algorithm name.
+func hashLen(name string) int {
+	h, err := newHash(name)
+	if err != nil {
+		return 0
+	}
+	return 2 * h.Size()
+}
+
+// HashFile returns the hex-encoded HashAlgorithm sum of the file at path.
+func HashFile(path string) (string, error) {
+	h, err := newHash(HashAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("problem opening file: %v", err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("problem calculating checksum on %q: %v", path, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// ReaddressFile moves the content blob at path to its address under
+// HashAlgorithm. Renaming keeps the inode, so hardlinks in date/ stay intact.
+// When Links is "symbolic" a symlink to the new address is left at the old
+// one, so that date/ keeps resolving until ResolveLinks is run. Blobs that
+// are already at their address are left alone; the address's length is not
+// enough to tell, as sha256 and blake2b-256 sums are the same length.
+func ReaddressFile(path, root string) error {
+	ext := filepath.Ext(path)
+	name := filepath.Base(filepath.Dir(path)) + strings.TrimSuffix(filepath.Base(path), ext)
+	sum, err := HashFile(path)
+	if err != nil {
+		return err
+	}
+	if sum == name {
+		return nil
+	}
+	m := Media{Path: path, Hash: sum, Extension: ext}
+	content := m.Content(root)
+	if _, err := os.Stat(content); !os.IsNotExist(err) {
+		return Dup{content}
+	}
+	if err := os.Rename(path, content); err != nil {
+		return fmt.Errorf("problem readdressing %q: %v", path, err)
+	}
+	if Links == "symbolic" {
+		if err := link(content, path); err != nil {
+			return fmt.Errorf("problem forwarding %q: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Readdress calls ReaddressFile on each blob on input chan.
+func Readdress(in <-chan string, root string) <-chan error {
+	out := make(chan error)
+	go func() {
+		for path := range in {
+			out <- ReaddressFile(path, root)
+		}
+		close(out)
+	}()
+	return out
+}
+
+// hashReader lets a Parser read and seek about a file while every byte of the
+// file is written to w exactly once, in order. Reading beyond what has been
+// written so far first pulls the gap through w, so seeking past e.g. the
+// frames of a video costs no more than hashing them would have anyway.
+type hashReader struct {
+	f      *os.File
+	w      io.Writer
+	pos    int64
+	hashed int64
+}
+
+// catchUp writes [hashed, off) to w.
+func (hr *hashReader) catchUp(off int64) error {
+	if off <= hr.hashed {
+		return nil
+	}
+	n, err := io.Copy(hr.w, io.NewSectionReader(hr.f, hr.hashed, off-hr.hashed))
+	hr.hashed += n
+	return err
+}
+
+func (hr *hashReader) Read(p []byte) (int, error) {
+	if err := hr.catchUp(hr.pos); err != nil {
+		return 0, err
+	}
+	n, err := hr.f.ReadAt(p, hr.pos)
+	if end := hr.pos + int64(n); end > hr.hashed {
+		if _, err := hr.w.Write(p[hr.hashed-hr.pos : n]); err != nil {
+			return 0, err
+		}
+		hr.hashed = end
+	}
+	hr.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (hr *hashReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += hr.pos
+	case io.SeekEnd:
+		fi, err := hr.f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += fi.Size()
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	hr.pos = offset
+	return offset, nil
+}
+
+// finish writes whatever of the file has not been read yet to w.
+func (hr *hashReader) finish() error {
+	n, err := io.Copy(hr.w, io.NewSectionReader(hr.f, hr.hashed, 1<<62))
+	hr.hashed += n
+	return err
+}
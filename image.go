@@ -1,24 +1,507 @@
 package arrange
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
 )
 
-func parseExif(f io.Reader) (time.Time, error) {
-	ti := time.Time{}
+var errNoTime = errors.New("format carries no time")
+
+type jpegParser struct{}
+
+func (jpegParser) Extensions() []string { return []string{".jpg", ".jpeg"} }
+
+func (jpegParser) Sniff(hdr []byte) bool {
+	return bytes.HasPrefix(hdr, []byte("\xff\xd8\xff"))
+}
+
+func (p jpegParser) Time(r io.ReadSeeker) (time.Time, error) {
+	c, err := p.captured(r)
+	return c.time, err
+}
+
+func (jpegParser) captured(r io.ReadSeeker) (capture, error) {
+	if _, err := jpeg.DecodeConfig(r); err != nil {
+		return capture{}, ErrFormat
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return capture{}, fmt.Errorf("couldn't seek back in file: %v", err)
+	}
+	c, err := parseExif(r)
+	return withXMP(c, err, jpegXMP(r))
+}
+
+type pngParser struct{}
+
+func (pngParser) Extensions() []string { return []string{".png"} }
+
+func (pngParser) Sniff(hdr []byte) bool {
+	return bytes.HasPrefix(hdr, []byte("\x89PNG\r\n\x1a\n"))
+}
+
+func (p pngParser) Time(r io.ReadSeeker) (time.Time, error) {
+	c, err := p.captured(r)
+	return c.time, err
+}
+
+func (pngParser) captured(r io.ReadSeeker) (capture, error) {
+	if _, err := png.DecodeConfig(r); err != nil {
+		return capture{}, ErrFormat
+	}
+	return withXMP(capture{}, errNoTime, pngXMP(r))
+}
+
+type gifParser struct{}
+
+func (gifParser) Extensions() []string { return []string{".gif"} }
+
+func (gifParser) Sniff(hdr []byte) bool {
+	return bytes.HasPrefix(hdr, []byte("GIF87a")) || bytes.HasPrefix(hdr, []byte("GIF89a"))
+}
+
+func (gifParser) Time(r io.ReadSeeker) (time.Time, error) {
+	if _, err := gif.DecodeConfig(r); err != nil {
+		return time.Time{}, ErrFormat
+	}
+	return time.Time{}, errNoTime
+}
+
+type heifParser struct{}
+
+func (heifParser) Extensions() []string { return []string{".heic", ".heif"} }
+
+func (heifParser) Sniff(hdr []byte) bool { return isHEIF(hdr) }
+
+func (heifParser) Time(r io.ReadSeeker) (time.Time, error) {
+	c, err := parseHEIF(r)
+	return c.time, err
+}
+
+func (heifParser) captured(r io.ReadSeeker) (capture, error) { return parseHEIF(r) }
+
+// Exif sub-IFD tags that goexif does not know about.
+const (
+	// tagOffsetTime, tagOffsetTimeOriginal and tagOffsetTimeDigitized are
+	// the zone offsets of DateTime, DateTimeOriginal and DateTimeDigitized,
+	// from EXIF 2.31.
+	tagOffsetTime          = 0x9010
+	tagOffsetTimeOriginal  = 0x9011
+	tagOffsetTimeDigitized = 0x9012
+	// tagBodySerialNumber is the camera's serial number, from EXIF 2.3.
+	tagBodySerialNumber = 0xa431
+)
+
+// maxOffset bounds the zone offsets that are believable.
+const maxOffset = 14 * time.Hour
+
+// gpsSlack is how far apart a camera's clock and its GPS fix may drift and
+// still be trusted to give a zone offset.
+const gpsSlack = 3 * time.Minute
+
+// exifTimes are the EXIF tags that hold times, the Time sources they are
+// known as, and the tags that hold their zone offsets.
+var exifTimes = []struct {
+	name   exif.FieldName
+	source string
+	offset uint16
+}{
+	{exif.DateTimeOriginal, TimeExif, tagOffsetTimeOriginal},
+	{exif.DateTimeDigitized, TimeDigitized, tagOffsetTimeDigitized},
+	{exif.DateTime, TimeDateTime, tagOffsetTime},
+}
+
+// parseExif extracts from f whichever of its times comes first in
+// TimePrecedence. Those times have no zone of their own, so each is placed
+// with its offset tag if there is one, or else (except for DateTime, which
+// is not when the picture was taken) by comparing it with the GPS time;
+// failing both it is read as local time.
+func parseExif(f io.Reader) (capture, error) {
+	c := capture{}
 	x, err := exif.Decode(f)
 	if err != nil {
 		if exif.IsCriticalError(err) {
-			return ti, err
+			return c, err
+		}
+	}
+
+	var wall time.Time
+	var offset uint16
+	for _, et := range exifTimes {
+		if rank(et.source) < 0 {
+			continue
+		}
+		t, ok := exifTime(x, et.name)
+		if ok && (c.source == "" || rank(et.source) < rank(c.source)) {
+			wall, offset, c.source = t, et.offset, et.source
 		}
 	}
-	tm, err := x.DateTime()
+	if c.source == "" {
+		return c, errors.New("no usable datetime in an ostensibly valid exif")
+	}
+
+	extra := exifStrings(x, offset, tagBodySerialNumber)
+	c.camera = camera{
+		make:   exifString(x, exif.Make),
+		model:  exifString(x, exif.Model),
+		serial: extra[tagBodySerialNumber],
+	}
+
+	if off, ok := zoneOffset(extra[offset]); ok {
+		c.time = wall.Add(-off).In(time.FixedZone("", int(off/time.Second)))
+		c.zone = ZoneOffset
+		return c, nil
+	}
+	if utc, ok := gpsTime(x); ok && c.source != TimeDateTime {
+		if off, ok := gpsOffset(wall, utc); ok {
+			c.time = wall.Add(-off).In(time.FixedZone("", int(off/time.Second)))
+			c.zone = ZoneGPS
+			return c, nil
+		}
+	}
+	c.time = time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, time.Local)
+	c.zone = ZoneLocal
+	return c, nil
+}
+
+// gpsOffset returns the zone offset that the camera clock reading wall was
+// set to, judging by the GPS fix at utc. The two are taken at much the same
+// moment, so their difference is the offset, give or take gpsSlack; any more
+// and one or the other is wrong, and it returns false.
+func gpsOffset(wall, utc time.Time) (time.Duration, bool) {
+	diff := wall.Sub(utc)
+	off := diff.Round(15 * time.Minute)
+	if d := diff - off; d < -gpsSlack || d > gpsSlack {
+		return 0, false
+	}
+	return off, off >= -maxOffset && off <= maxOffset
+}
+
+// exifTime returns the wall clock time in x's tag name, as if it were UTC.
+func exifTime(x *exif.Exif, name exif.FieldName) (time.Time, bool) {
+	s := exifString(x, name)
+	if s == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", s)
 	if err != nil {
-		return ti, fmt.Errorf("no datetime in an ostensibly valid exif %v", err)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// exifString returns the value of x's string tag name, if it has one.
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(s)
+}
+
+// exifStrings returns the values of the string tags ids found in x's Exif
+// sub-IFD.
+func exifStrings(x *exif.Exif, ids ...uint16) map[uint16]string {
+	vals := map[uint16]string{}
+	ptr, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return vals
+	}
+	pos, err := ptr.Int64(0)
+	if err != nil {
+		return vals
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return vals
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return vals
+	}
+	for _, tag := range dir.Tags {
+		for _, id := range ids {
+			if tag.Id != id {
+				continue
+			}
+			if s, err := tag.StringVal(); err == nil {
+				vals[id] = strings.TrimSpace(s)
+			}
+		}
+	}
+	return vals
+}
+
+// zoneOffset parses an EXIF offset from UTC, such as "+09:00".
+func zoneOffset(s string) (time.Duration, bool) {
+	t, err := time.Parse("-07:00", s)
+	if err != nil {
+		return 0, false
+	}
+	_, secs := t.Zone()
+	off := time.Duration(secs) * time.Second
+	return off, off >= -maxOffset && off <= maxOffset
+}
+
+// gpsTime returns the UTC time of x's GPS fix.
+func gpsTime(x *exif.Exif) (time.Time, bool) {
+	ds, err := x.Get(exif.GPSDateStamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	s, err := ds.StringVal()
+	if err != nil {
+		return time.Time{}, false
+	}
+	day, err := time.Parse("2006:01:02", strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}, false
+	}
+	ts, err := x.Get(exif.GPSTimeStamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	secs := 0.0
+	for i, unit := range []float64{3600, 60, 1} {
+		num, den, err := ts.Rat2(i)
+		if err != nil || den == 0 {
+			return time.Time{}, false
+		}
+		secs += unit * float64(num) / float64(den)
+	}
+	return day.Add(time.Duration(secs * float64(time.Second))), true
+}
+
+// heifBrands are the ftyp brands of HEIF still images.
+var heifBrands = map[string]bool{
+	"heic": true,
+	"heix": true,
+	"heim": true,
+	"heis": true,
+	"hevc": true,
+	"hevx": true,
+	"mif1": true,
+	"msf1": true,
+}
+
+// parseHEIF validates that r is a HEIF image and extracts the time from its
+// Exif item. It returns ErrFormat if r is not a HEIF image.
+func parseHEIF(r io.ReadSeeker) (capture, error) {
+	ti := capture{}
+	hdr, err := header(r)
+	if err != nil {
+		return ti, err
+	}
+	if !isHEIF(hdr) {
+		return ti, ErrFormat
+	}
+
+	f, err := whole(r)
+	if err != nil {
+		return ti, err
+	}
+	meta, err := child(r, f, 0, "meta")
+	if err != nil {
+		return ti, ErrFormat
+	}
+	buf, err := heifExif(r, meta)
+	if err != nil {
+		return ti, err
+	}
+	// The Exif item starts with the offset to the TIFF header.
+	if len(buf) < 4 {
+		return ti, errors.New("short Exif item")
+	}
+	off := 4 + int(binary.BigEndian.Uint32(buf[:4]))
+	if off > len(buf) {
+		return ti, errors.New("bad TIFF header offset in Exif item")
+	}
+	return parseExif(bytes.NewReader(buf[off:]))
+}
+
+// heifExif returns the contents of the Exif item in meta.
+func heifExif(r io.ReadSeeker, meta box) ([]byte, error) {
+	iinf, err := child(r, meta, 4, "iinf")
+	if err != nil {
+		return nil, err
+	}
+	buf, err := payload(r, iinf)
+	if err != nil {
+		return nil, err
+	}
+	skip := int64(6)
+	if len(buf) > 0 && buf[0] != 0 {
+		skip = 8
+	}
+	infes, err := boxes(r, iinf.start+skip, iinf.end)
+	if err != nil {
+		return nil, err
+	}
+	id := uint32(0)
+	for _, infe := range infes {
+		if infe.typ != "infe" {
+			continue
+		}
+		buf, err := payload(r, infe)
+		if err != nil {
+			return nil, err
+		}
+		var typ []byte
+		switch {
+		case len(buf) >= 12 && buf[0] == 2:
+			id = uint32(binary.BigEndian.Uint16(buf[4:6]))
+			typ = buf[8:12]
+		case len(buf) >= 14 && buf[0] == 3:
+			id = binary.BigEndian.Uint32(buf[4:8])
+			typ = buf[10:14]
+		default:
+			continue
+		}
+		if string(typ) == "Exif" {
+			break
+		}
+		id = 0
+	}
+	if id == 0 {
+		return nil, errors.New("no Exif item")
+	}
+
+	iloc, err := child(r, meta, 4, "iloc")
+	if err != nil {
+		return nil, err
+	}
+	buf, err = payload(r, iloc)
+	if err != nil {
+		return nil, err
+	}
+	return ilocItem(r, meta, buf, id)
+}
+
+// ilocItem reads item id from r using the location information in iloc.
+func ilocItem(r io.ReadSeeker, meta box, iloc []byte, id uint32) ([]byte, error) {
+	bad := errors.New("malformed iloc box")
+	p := 0
+	next := func(n int) (uint64, error) {
+		if p+n > len(iloc) {
+			return 0, bad
+		}
+		var v uint64
+		for _, b := range iloc[p : p+n] {
+			v = v<<8 | uint64(b)
+		}
+		p += n
+		return v, nil
+	}
+
+	version, err := next(4)
+	if err != nil {
+		return nil, err
+	}
+	version >>= 24
+	sizes, err := next(2)
+	if err != nil {
+		return nil, err
+	}
+	offSize := int(sizes >> 12 & 0xf)
+	lenSize := int(sizes >> 8 & 0xf)
+	baseSize := int(sizes >> 4 & 0xf)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xf)
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count, err := next(idSize)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < count; i++ {
+		item, err := next(idSize)
+		if err != nil {
+			return nil, err
+		}
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			if method, err = next(2); err != nil {
+				return nil, err
+			}
+			method &= 0xf
+		}
+		if _, err := next(2); err != nil {
+			return nil, err
+		}
+		base, err := next(baseSize)
+		if err != nil {
+			return nil, err
+		}
+		extents, err := next(2)
+		if err != nil {
+			return nil, err
+		}
+
+		var out []byte
+		for e := uint64(0); e < extents; e++ {
+			if _, err := next(indexSize); err != nil {
+				return nil, err
+			}
+			off, err := next(offSize)
+			if err != nil {
+				return nil, err
+			}
+			length, err := next(lenSize)
+			if err != nil {
+				return nil, err
+			}
+			if item != uint64(id) {
+				continue
+			}
+			var parent box
+			switch method {
+			case 0:
+				if parent, err = whole(r); err != nil {
+					return nil, err
+				}
+			case 1:
+				if parent, err = child(r, meta, 4, "idat"); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("unsupported iloc construction method %d", method)
+			}
+			// The extent must lie within its parent; checked in uint64 so
+			// that huge offsets and lengths can't wrap around.
+			size := uint64(parent.size())
+			if base > size || off > size-base || length > size-base-off {
+				return nil, bad
+			}
+			b := box{typ: "Exif", start: parent.start + int64(base+off)}
+			b.end = b.start + int64(length)
+			buf, err := payload(r, b)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, buf...)
+		}
+		if item == uint64(id) {
+			return out, nil
+		}
 	}
-	return tm, nil
+	return nil, fmt.Errorf("no location for item %d", id)
 }
@@ -0,0 +1,115 @@
+package arrange
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Links is how entries in date/ refer to their content: "hard" for hardlinks,
+// or "symbolic" for relative symlinks, which survive tools that don't
+// understand hardlinks.
+var Links = "hard"
+
+func checkLinks(kind string) error {
+	switch kind {
+	case "hard", "symbolic":
+		return nil
+	}
+	return fmt.Errorf("unsupported link kind %q (want hard or symbolic)", kind)
+}
+
+// link makes name refer to content as Links says it should.
+func link(content, name string) error {
+	if Links == "symbolic" {
+		rel, err := filepath.Rel(filepath.Dir(name), content)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(rel, name)
+	}
+	return os.Link(content, name)
+}
+
+// linked reports whether the date entry at name refers to content as Links
+// says it should.
+func linked(name, content string) (bool, error) {
+	d, err := os.Lstat(name)
+	if err != nil {
+		return false, err
+	}
+	if Links == "symbolic" {
+		if d.Mode()&os.ModeSymlink == 0 {
+			return false, nil
+		}
+		target, err := os.Readlink(name)
+		if err != nil {
+			return false, err
+		}
+		rel, err := filepath.Rel(filepath.Dir(name), content)
+		if err != nil {
+			return false, err
+		}
+		return target == rel, nil
+	}
+	if !d.Mode().IsRegular() {
+		return false, nil
+	}
+	c, err := os.Stat(content)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(d, c), nil
+}
+
+// Relink replaces the date entry at name with a link to content, as Links
+// says it should be.
+func Relink(name, content string) error {
+	if _, err := os.Stat(content); err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	return link(content, name)
+}
+
+// ResolveLinks points every symlink in root's date tree straight at the file
+// it resolves to, and then removes any symlinks left in the content store,
+// such as those ReaddressFile leaves behind.
+func ResolveLinks(root string) error {
+	err := filepath.Walk(
+		filepath.Join(root, "date"),
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				return nil
+			}
+			content, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return fmt.Errorf("problem resolving %q: %v", path, err)
+			}
+			if ok, err := linked(path, content); err != nil || ok {
+				return err
+			}
+			return Relink(path, content)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(
+		filepath.Join(root, "content"),
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				return os.Remove(path)
+			}
+			return nil
+		},
+	)
+}
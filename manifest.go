@@ -0,0 +1,389 @@
+package arrange
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManifestDir is where a tree keeps the Manifests of the runs that added to
+// it, relative to its root.
+const ManifestDir = "imports"
+
+// Record is what a Manifest says about one Media.
+type Record struct {
+	// Source is the absolute path the Media was found at.
+	Source     string    `json:"source"`
+	Hash       string    `json:"hash"`
+	Time       time.Time `json:"time"`
+	TimeSource string    `json:"time_source"`
+	Zone       string    `json:"zone,omitempty"`
+
+	// Skew is the correction made to Time by a Skew, like "-8761h0m0s".
+	Skew string `json:"skew,omitempty"`
+
+	// Content and Date are relative to the tree's root. Date is empty
+	// unless the Media was moved, and Content if it couldn't be parsed.
+	Content string `json:"content"`
+	Date    string `json:"date,omitempty"`
+
+	// Outcome is "moved", "dup" or "error".
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+
+	// Removed is set if the original at Source was removed.
+	Removed bool `json:"removed,omitempty"`
+
+	// Size is the size of the blob at Content when this run added it, so
+	// that verify can tell a truncated blob from a corrupt one.
+	Size int64 `json:"size,omitempty"`
+
+	// Rating is the Media's XMP rating.
+	Rating int `json:"rating,omitempty"`
+
+	// Sidecar is where the Media's sidecar was carried, relative to the
+	// tree's root, from the absolute path SidecarSource. Removed applies
+	// to it too.
+	Sidecar       string `json:"sidecar,omitempty"`
+	SidecarSource string `json:"sidecar_source,omitempty"`
+}
+
+// Manifest is a JSON-lines log of what a run did to a tree, one Record per
+// line.
+type Manifest struct {
+	mu   sync.Mutex
+	root string
+	f    *os.File
+	enc  *json.Encoder
+}
+
+// CreateManifest starts a new Manifest in root's ManifestDir, named for
+// start.
+func CreateManifest(root string, start time.Time) (*Manifest, error) {
+	dir := filepath.Join(root, ManifestDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, start.UTC().Format("20060102T150405.000000000Z")+".jsonl")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("problem creating manifest: %v", err)
+	}
+	return &Manifest{root: root, f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Name returns the path of the file m is written to.
+func (m *Manifest) Name() string {
+	return m.f.Name()
+}
+
+// Write records r in m.
+func (m *Manifest) Write(r Result) error {
+	rec := Record{
+		Hash:       r.Media.Hash,
+		Time:       r.Media.Time,
+		TimeSource: r.Media.TimeSource,
+		Zone:       r.Media.Zone,
+		Outcome:    "moved",
+		Removed:    r.Removed,
+		Size:       r.Size,
+		Rating:     r.Media.Rating,
+	}
+	if r.Media.Skew != 0 {
+		rec.Skew = r.Media.Skew.String()
+	}
+	var err error
+	if rec.Source, err = filepath.Abs(r.Media.Path); err != nil {
+		return err
+	}
+	if r.Content != "" {
+		if rec.Content, err = filepath.Rel(m.root, r.Content); err != nil {
+			return err
+		}
+	}
+	if r.Date != "" {
+		if rec.Date, err = filepath.Rel(m.root, r.Date); err != nil {
+			return err
+		}
+	}
+	if r.Sidecar != "" {
+		if rec.Sidecar, err = filepath.Rel(m.root, r.Sidecar); err != nil {
+			return err
+		}
+		if rec.SidecarSource, err = filepath.Abs(r.Media.Sidecar); err != nil {
+			return err
+		}
+	}
+	switch r.Err.(type) {
+	case nil:
+	case Dup:
+		rec.Outcome = "dup"
+	default:
+		rec.Outcome = "error"
+		rec.Error = r.Err.Error()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.enc.Encode(rec)
+}
+
+// Close flushes m to disk and closes it.
+func (m *Manifest) Close() error {
+	if err := m.f.Sync(); err != nil {
+		m.f.Close()
+		return err
+	}
+	return m.f.Close()
+}
+
+// ReadManifest returns the Records in the Manifest at path.
+func ReadManifest(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem opening manifest: %v", err)
+	}
+	defer f.Close()
+
+	recs := []Record{}
+	dec := json.NewDecoder(f)
+	for {
+		rec := Record{}
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("problem reading manifest %q: %v", path, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// BlobSizes returns the size of each blob, by hash, that the Manifests in
+// root's ManifestDir record adding.
+func BlobSizes(root string) (map[string]int64, error) {
+	names, err := filepath.Glob(filepath.Join(root, ManifestDir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	for _, name := range names {
+		recs, err := ReadManifest(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range recs {
+			if rec.Size > 0 {
+				sizes[rec.Hash] = rec.Size
+			}
+		}
+	}
+	return sizes, nil
+}
+
+// Undo reverses the run recorded in the Manifest at name against root.
+// Originals it removed are put back, the date entries and sidecars it added
+// are removed, and so is the content it introduced, unless something else in
+// the date tree has come to link to it since, or another Manifest removed an
+// original that only that content can put back. Content that was already in
+// the store is left alone.
+//
+// Stale temporary files that an interrupted Undo left beside the originals
+// are swept away. Problems with single Records are logged and counted in the
+// returned error, and don't stop the rest being undone.
+func Undo(name, root string) error {
+	recs, err := ReadManifest(name)
+	if err != nil {
+		return err
+	}
+	needed, err := neededBlobs(root, name)
+	if err != nil {
+		return err
+	}
+
+	// an earlier, interrupted Undo may have left temporary files beside
+	// the originals it was putting back
+	swept := map[string]bool{}
+	sweep := func(path string) {
+		dir := filepath.Dir(path)
+		if swept[dir] {
+			return
+		}
+		swept[dir] = true
+		if _, err := sweepDir(dir); err != nil && !os.IsNotExist(err) {
+			log.Printf("problem sweeping temporary files: %v", err)
+		}
+	}
+
+	failed := 0
+	for _, rec := range recs {
+		if !rec.Removed {
+			continue
+		}
+		sweep(rec.Source)
+		if rec.Sidecar != "" {
+			sweep(rec.SidecarSource)
+		}
+		if rec.Sidecar != "" && !exists(rec.SidecarSource) {
+			if _, err := copySidecar(filepath.Join(root, rec.Sidecar), rec.SidecarSource); err != nil {
+				log.Printf("problem restoring %q: %v", rec.SidecarSource, err)
+				failed++
+			}
+		}
+		if exists(rec.Source) {
+			continue
+		}
+		if err := rec.restore(root); err != nil {
+			log.Printf("problem restoring %q: %v", rec.Source, err)
+			failed++
+		}
+	}
+
+	added := map[string]bool{}
+	for _, rec := range recs {
+		if rec.Outcome != "moved" {
+			continue
+		}
+		content := filepath.Join(root, rec.Content)
+		added[content] = true
+		if err := rec.unlink(root); err != nil {
+			log.Printf("problem removing %q: %v", rec.Date, err)
+			failed++
+		}
+	}
+
+	for err := range Fsck(root) {
+		switch e := err.(type) {
+		case Orphan:
+			if !added[e.Path] || needed[e.Path] {
+				continue
+			}
+			if err := os.Remove(e.Path); err != nil {
+				log.Printf("%+v", err)
+				failed++
+			}
+		case Dangling, BadAddress:
+		default:
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d parts of the run could not be undone", failed)
+	}
+	return nil
+}
+
+// neededBlobs returns the content, by path, that the Manifests in root's
+// ManifestDir other than the one at except would need to put back the
+// originals they removed.
+func neededBlobs(root, except string) (map[string]bool, error) {
+	names, err := filepath.Glob(filepath.Join(root, ManifestDir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	self, err := os.Stat(except)
+	if err != nil {
+		return nil, err
+	}
+	needed := map[string]bool{}
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if os.SameFile(fi, self) {
+			continue
+		}
+		recs, err := ReadManifest(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range recs {
+			if rec.Removed && rec.Content != "" {
+				needed[filepath.Join(root, rec.Content)] = true
+			}
+		}
+	}
+	return needed, nil
+}
+
+// restore copies rec's content back to where it was found.
+func (rec Record) restore(root string) error {
+	src, err := os.Open(filepath.Join(root, rec.Content))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(rec.Source), 0755); err != nil {
+		return err
+	}
+	dst, err := ioutil.TempFile(filepath.Dir(rec.Source), tempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = copyFile(dst, src)
+	if err == nil {
+		err = dst.Chmod(0644)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	// a time that came from the file's mtime is the best guess at it
+	if err == nil && rec.TimeSource == TimeMtime {
+		err = os.Chtimes(dst.Name(), time.Now(), rec.Time)
+	}
+	if err == nil {
+		err = commit(dst.Name(), rec.Source)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return err
+}
+
+// unlink removes the date entry rec added, if it still refers to rec's
+// content, along with its sidecar, and then any date directories left empty.
+func (rec Record) unlink(root string) error {
+	name := filepath.Join(root, rec.Date)
+	d, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c, err := os.Stat(filepath.Join(root, rec.Content))
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(d, c) {
+		return fmt.Errorf("%q no longer refers to %q", name, rec.Content)
+	}
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	if rec.Sidecar != "" {
+		if err := os.Remove(filepath.Join(root, rec.Sidecar)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// fails harmlessly unless empty
+	top := filepath.Join(root, "date")
+	for dir := filepath.Dir(name); dir != top && strings.HasPrefix(dir, top); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -1,10 +1,13 @@
 package arrange
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -14,61 +17,413 @@ type Media struct {
 	Hash      string
 	Extension string
 	Time      time.Time
+
+	// TimeSource is where Time came from, one of TimePrecedence.
+	TimeSource string
+
+	// Zone is how the zone of Time was found: ZoneOffset, ZoneGPS, ZoneUTC
+	// or ZoneLocal. It is empty when nothing is known, as for TimeMtime.
+	Zone string
+
+	// Skew is how far Time was corrected from what the file says, by one
+	// of Skews.
+	Skew time.Duration
+
+	// Rating is the XMP rating: 1 to 5 stars, -1 for rejected, or 0 for
+	// none.
+	Rating int
+
+	// Sidecar is the path of the file's XMP sidecar, if it has one. It is
+	// carried into the date tree along with the file.
+	Sidecar string
+
+	// Misnamed is the extension the file was found with, if sniffing
+	// determined that it is really some other format.
+	Misnamed string
+
+	// staged is a temporary copy of the file in the content store, made
+	// while it was parsed.
+	staged string
 }
 
+// Where a Media's Time can come from.
+const (
+	// TimeExif is an EXIF DateTimeOriginal, wherever in the file it was.
+	TimeExif = "exif"
+	// TimeDigitized is an EXIF DateTimeDigitized, which some tools call
+	// CreateDate.
+	TimeDigitized = "exif-digitized"
+	// TimeDateTime is an EXIF DateTime, which editors change whenever they
+	// save the file.
+	TimeDateTime = "exif-datetime"
+	// TimeXMP is an XMP CreateDate or DateCreated, from the file or its
+	// sidecar.
+	TimeXMP = "xmp"
+	// TimeContainer is a time kept by the file's own format, such as a
+	// QuickTime movie header.
+	TimeContainer = "container"
+	// TimeFilename is a date in the file's name; see NamePatterns.
+	TimeFilename = "filename"
+	// TimeMtime is the file's modification time.
+	TimeMtime = "mtime"
+)
+
+// TimePrecedence lists the sources ParseFile takes a Media's Time from, best
+// first. Sources that are left out are never used, and a file with none of
+// the others fails to parse.
+var TimePrecedence = []string{TimeExif, TimeDigitized, TimeDateTime, TimeXMP, TimeContainer, TimeFilename, TimeMtime}
+
+// rank returns the position of source in TimePrecedence, or -1.
+func rank(source string) int {
+	for i, s := range TimePrecedence {
+		if s == source {
+			return i
+		}
+	}
+	return -1
+}
+
+// CheckPrecedence makes sure that sources is a usable TimePrecedence.
+func CheckPrecedence(sources []string) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("no time sources")
+	}
+	seen := map[string]bool{}
+	for _, s := range sources {
+		switch s {
+		case TimeExif, TimeDigitized, TimeDateTime, TimeXMP, TimeContainer, TimeFilename, TimeMtime:
+		default:
+			return fmt.Errorf("unknown time source %q", s)
+		}
+		if seen[s] {
+			return fmt.Errorf("time source %q given twice", s)
+		}
+		seen[s] = true
+	}
+	return nil
+}
+
+// How a Media's Time can be placed in a zone.
+const (
+	// ZoneOffset is an offset recorded alongside the time, such as EXIF
+	// 2.31's OffsetTimeOriginal.
+	ZoneOffset = "offset"
+	// ZoneGPS is an offset worked out from the difference between the
+	// camera's clock and a GPS fix.
+	ZoneGPS = "gps"
+	// ZoneUTC is a time the file's format always keeps in UTC.
+	ZoneUTC = "utc"
+	// ZoneLocal is a time recorded with no zone at all, and so read in the
+	// local zone.
+	ZoneLocal = "local"
+)
+
+// tempPrefix starts the names of temporary files in the content store.
+const tempPrefix = ".arrange-"
+
 // Move is called to push Media into its final destination, by content address
 // and by date.
 func (m Media) Move(root string) error {
-	f, err := os.Open(m.Path)
-	if err != nil {
-		return fmt.Errorf("problem opening file %q: %v", m.Path, err)
-	}
-	defer f.Close()
+	return m.Place(root, false).Err
+}
 
-	content := m.Content(root)
+// Take is like Move, but also removes the original file once its content is
+// verified to be in the store. When the original is on the same filesystem it
+// is linked into place rather than copied.
+//
+// The original is kept if anything goes wrong, or if it duplicates a content
+// file of a different size.
+func (m Media) Take(root string) error {
+	return m.Place(root, true).Err
+}
 
-	if _, err := os.Stat(content); !os.IsNotExist(err) {
+// Place does the work of Move, or of Take if take is set, and reports how it
+// went.
+func (m Media) Place(root string, take bool) Result {
+	r := Result{Media: m, Content: m.Content(root)}
+	r.Err = m.place(&r, root, take)
+	return r
+}
+
+// place gets m's data into a temporary file beside content, makes sure it is
+// complete and correct, and only then gives it its address, so that nothing
+// but a whole, verified file is ever found at a content address.
+func (m Media) place(r *Result, root string, take bool) error {
+	content := r.Content
+
+	// A duplicate's sidecar has no date entry to go beside, so when it has
+	// one the original is kept with it.
+	dup := func() error {
+		if take && m.Sidecar == "" {
+			if err := m.dropDup(content); err != nil {
+				return err
+			}
+			r.Removed = !exists(m.Path)
+		}
 		return Dup{content}
 	}
 
-	out, err := os.Create(content)
-	if err != nil {
-		return fmt.Errorf("could not create output file: %v", err)
+	if _, err := os.Stat(content); !os.IsNotExist(err) {
+		if m.staged != "" {
+			os.Remove(m.staged)
+		}
+		return dup()
 	}
-	defer out.Close()
 
-	if _, err := io.Copy(out, f); err != nil {
-		return fmt.Errorf("trouble copying file: %v", err)
+	var tmp string
+	switch {
+	case m.staged != "":
+		// hashed as it was written, so already verified
+		tmp, r.Strategy = m.staged, Staged
+	case take:
+		if t, err := linkTemp(m.Path, filepath.Dir(content)); err == nil {
+			tmp, r.Strategy = t, Linked
+		}
+	}
+	if tmp == "" {
+		t, s, err := m.copy(filepath.Dir(content))
+		if err != nil {
+			return err
+		}
+		tmp, r.Strategy = t, s
+	}
+
+	if r.Strategy != Staged {
+		sum, err := HashFile(tmp)
+		if err == nil && sum != m.Hash {
+			err = fmt.Errorf("hash is %s, not %s", sum, m.Hash)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("could not verify content of %q, keeping it: %v", m.Path, err)
+		}
 	}
 
-	if err := os.Chtimes(content, time.Now(), m.Time); err != nil {
+	if err := os.Chtimes(tmp, time.Now(), m.Time); err != nil {
+		os.Remove(tmp)
 		return fmt.Errorf("couldn't chtimes for %q: %v", content, err)
 	}
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
 
-	year := fmt.Sprintf("%04d", m.Time.Year())
-	month := fmt.Sprintf("%02d", m.Time.Month())
-	ts := fmt.Sprintf("%d", m.Time.UnixNano())
+	if err := commit(tmp, content); err != nil {
+		os.Remove(tmp)
+		if os.IsExist(err) {
+			// another worker got there first
+			return dup()
+		}
+		return fmt.Errorf("could not move file into place: %v", err)
+	}
+	r.Size = fi.Size()
 
-	if err := os.MkdirAll(filepath.Join(root, "date", year, month), 0755); err != nil {
+	name, err := m.date(root, exists)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
 		return fmt.Errorf("problem creating date directory: %v", err)
 	}
 
-	date := filepath.Join(root, "date", year, month, ts)
-	name := date + m.Extension
+	if err := link(content, name); err != nil {
+		return err
+	}
+	r.Date = name
+
+	if m.Sidecar != "" {
+		sidecar := m.sidecarDate(name)
+		ok, err := copySidecar(m.Sidecar, sidecar)
+		if err != nil {
+			return fmt.Errorf("problem carrying sidecar %q: %v", m.Sidecar, err)
+		}
+		if ok {
+			r.Sidecar = sidecar
+		}
+	}
+
+	if take {
+		if err := os.Remove(m.Path); err != nil {
+			return fmt.Errorf("problem removing original: %v", err)
+		}
+		r.Removed = true
+		// a sidecar named for a base name can belong to several files, and
+		// goes with the last of them
+		if r.Sidecar != "" && !sidecarShared(m.Path, m.Sidecar) {
+			if err := os.Remove(m.Sidecar); err != nil {
+				return fmt.Errorf("problem removing original sidecar: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// commit gives the complete file at tmp the name content, unless something
+// is already there. tmp is gone afterwards unless commit fails.
+func commit(tmp, content string) error {
+	err := os.Link(tmp, content)
+	switch {
+	case err == nil:
+		return os.Remove(tmp)
+	case os.IsExist(err):
+		return err
+	}
+	// the store's filesystem may not do hardlinks
+	return os.Rename(tmp, content)
+}
+
+// linkTemp hardlinks path to a new temporary name in dir.
+func linkTemp(path, dir string) (string, error) {
+	f, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	f.Close()
+	if err := os.Remove(tmp); err != nil {
+		return "", err
+	}
+	if err := os.Link(path, tmp); err != nil {
+		return "", err
+	}
+	return tmp, nil
+}
+
+// dropDup removes the original of m, whose content is already at content,
+// unless their bytes differ. An original that is itself the content file (or
+// a hardlink to it) is left alone.
+func (m Media) dropDup(content string) error {
+	linked, err := m.dupOf(content)
+	if err != nil || linked {
+		return err
+	}
+	if err := os.Remove(m.Path); err != nil {
+		return fmt.Errorf("problem removing duplicate original: %v", err)
+	}
+	return nil
+}
+
+// dupOf checks that the original of m holds the same bytes as the file at
+// content, returning a Collision if not, and reports whether it is that very
+// file.
+func (m Media) dupOf(content string) (bool, error) {
+	c, err := os.Stat(content)
+	if err != nil {
+		return false, err
+	}
+	o, err := os.Stat(m.Path)
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(c, o) {
+		return true, nil
+	}
+	if c.Size() != o.Size() {
+		return false, Collision{Path: m.Path, Content: content}
+	}
+	// the hash was taken at parse time, and the original may have changed
+	// since; only bytes still in the store make it safe to remove
+	same, err := sameContent(m.Path, content)
+	if err != nil {
+		return false, err
+	}
+	if !same {
+		return false, Collision{Path: m.Path, Content: content}
+	}
+	return false, nil
+}
+
+// sameContent reports whether the files at a and b hold the same bytes.
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	ba := make([]byte, 64<<10)
+	bb := make([]byte, len(ba))
+	for {
+		na, erra := io.ReadFull(fa, ba)
+		nb, errb := io.ReadFull(fb, bb)
+		if !bytes.Equal(ba[:na], bb[:nb]) {
+			return false, nil
+		}
+		aDone := erra == io.EOF || erra == io.ErrUnexpectedEOF
+		bDone := errb == io.EOF || errb == io.ErrUnexpectedEOF
+		if erra != nil && !aDone {
+			return false, erra
+		}
+		if errb != nil && !bDone {
+			return false, errb
+		}
+		if aDone || bDone {
+			return aDone && bDone, nil
+		}
+	}
+}
+
+// date returns the first path in the date tree starting at root, named by
+// DateTemplate in DateZone, for which taken returns false.
+func (m Media) date(root string, taken func(string) bool) (string, error) {
+	rel, err := m.datePath(DateTemplate, DateZone)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(root, "date", rel)
+	date := strings.TrimSuffix(name, m.Extension)
 	for i := 0; i < 10000; i++ {
-		if _, err := os.Stat(name); os.IsNotExist(err) {
+		if !taken(name) {
 			break
 		}
 		name = fmt.Sprintf("%s_%04d%s", date, i, m.Extension)
 	}
+	return name, nil
+}
 
-	// TODO: or maybe symlinking? (issue #2)
-	// rel := filepath.Join("..", "..", "..", "content", j.hash[:2], j.hash[2:]+m.Extension)
-	// return os.Symlink(rel, name)
-	return os.Link(content, name)
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return !os.IsNotExist(err)
 }
 
 // Content returns the content-address path starting at root.
 func (m Media) Content(root string) string {
 	return filepath.Join(root, "content", m.Hash[:2], m.Hash[2:]+m.Extension)
 }
+
+// copy copies m into a new temporary file in dir using CopyStrategy, and
+// reports its name and the strategy that worked. Nothing is left behind on
+// failure.
+func (m Media) copy(dir string) (string, Strategy, error) {
+	f, err := os.Open(m.Path)
+	if err != nil {
+		return "", Auto, fmt.Errorf("problem opening file %q: %v", m.Path, err)
+	}
+	defer f.Close()
+
+	out, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return "", Auto, fmt.Errorf("could not create output file: %v", err)
+	}
+
+	s, err := copyFile(out, f)
+	if err == nil {
+		err = out.Chmod(0644)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", s, fmt.Errorf("trouble copying file (%s): %v", s, err)
+	}
+	return out.Name(), s, nil
+}
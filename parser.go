@@ -0,0 +1,131 @@
+package arrange
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Parser knows how to recognize and date one kind of media file.
+//
+// Implementations are registered with Register, after which Source, Parse
+// and ParseFile handle their files like any of the built-in formats.
+type Parser interface {
+	// Extensions returns the lower-case extensions, including the leading
+	// dot, that files of this kind are named with. The first one is
+	// canonical and is used when a file is detected by Sniff.
+	Extensions() []string
+
+	// Sniff reports whether hdr, the first bytes of a file, look like this
+	// kind of file. hdr may be shorter than the file.
+	Sniff(hdr []byte) bool
+
+	// Time validates r and returns the time it was captured. It returns
+	// ErrFormat if r is not this kind of file at all; any other error (or a
+	// zero time) means r is fine but the time must be found elsewhere.
+	Time(r io.ReadSeeker) (time.Time, error)
+}
+
+// capture is a capture time and what is known about where it came from.
+type capture struct {
+	time time.Time
+
+	// source is where time came from, one of TimePrecedence.
+	source string
+
+	// zone is how time's zone was found: ZoneOffset, ZoneGPS, ZoneUTC,
+	// ZoneLocal, or empty if nothing is known.
+	zone string
+
+	// camera identifies the device that recorded time, if known.
+	camera camera
+
+	// skew is how far time has been corrected by Skews.
+	skew time.Duration
+
+	// rating is the XMP rating, if any.
+	rating int
+}
+
+// capturer is implemented by Parsers that know more about their times than
+// Time reports. The time of any other Parser is a TimeContainer in an unknown
+// zone.
+type capturer interface {
+	// captured is like Time, but also reports where the time came from.
+	captured(r io.ReadSeeker) (capture, error)
+}
+
+// namer is implemented by Parsers whose canonical extension depends on the
+// contents of the file.
+type namer interface {
+	name(hdr []byte) string
+}
+
+var registry = struct {
+	sync.RWMutex
+	parsers []Parser
+	exts    map[string]Parser
+}{
+	exts: map[string]Parser{},
+}
+
+// Register makes p available for its extensions. Parsers registered later take
+// precedence over earlier ones, both for extensions and for sniffing, so that
+// a built-in format can be replaced.
+func Register(p Parser) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.parsers = append(registry.parsers, p)
+	for _, ext := range p.Extensions() {
+		registry.exts[ext] = p
+	}
+}
+
+// unregister undoes the latest Register of p, giving its extensions back to
+// the Parsers registered before it.
+func unregister(p Parser) {
+	registry.Lock()
+	defer registry.Unlock()
+	for i := len(registry.parsers) - 1; i >= 0; i-- {
+		if registry.parsers[i] == p {
+			registry.parsers = append(registry.parsers[:i:i], registry.parsers[i+1:]...)
+			break
+		}
+	}
+	registry.exts = map[string]Parser{}
+	for _, q := range registry.parsers {
+		for _, ext := range q.Extensions() {
+			registry.exts[ext] = q
+		}
+	}
+}
+
+// lookup returns the Parser for files named with ext, or nil.
+func lookup(ext string) Parser {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.exts[ext]
+}
+
+// detect returns the most recently registered Parser that recognizes hdr, or
+// nil.
+func detect(hdr []byte) Parser {
+	registry.RLock()
+	defer registry.RUnlock()
+	for i := len(registry.parsers) - 1; i >= 0; i-- {
+		if p := registry.parsers[i]; p.Sniff(hdr) {
+			return p
+		}
+	}
+	return nil
+}
+
+// canonical returns the extension to use for a file detected as p.
+func canonical(p Parser, hdr []byte) string {
+	if n, ok := p.(namer); ok {
+		if ext := n.name(hdr); ext != "" {
+			return ext
+		}
+	}
+	return p.Extensions()[0]
+}
@@ -0,0 +1,83 @@
+package arrange
+
+// Result describes what Move did, or would do, with one Media.
+type Result struct {
+	Media   Media
+	Content string
+	Date    string
+	Err     error
+
+	// Strategy is how the data got into the content store. It is empty for
+	// planned Results and for duplicates.
+	Strategy Strategy
+
+	// Removed is set if Take removed the original, and its sidecar if that
+	// was carried.
+	Removed bool
+
+	// Sidecar is where the Media's sidecar was copied in the date tree, if
+	// it was.
+	Sidecar string
+
+	// Size is the size of the blob at Content, if this put it there.
+	Size int64
+}
+
+// Planner works out what Move would do with a series of Media without
+// touching the output tree. It accounts for the Media it has already planned,
+// so duplicates and date collisions within a run are reported as they would
+// happen.
+type Planner struct {
+	// Take makes Plan report what Take, rather than Move, would do: a
+	// duplicate's original is Removed unless it has a sidecar, is the
+	// content file itself, or differs from it, which is a Collision.
+	Take bool
+
+	root  string
+	taken map[string]bool
+}
+
+// NewPlanner returns a Planner for the output tree at root.
+func NewPlanner(root string) *Planner {
+	return &Planner{
+		root:  root,
+		taken: map[string]bool{},
+	}
+}
+
+// Plan returns what Move, or Take, would do with m. Its Err is a Dup if m
+// would not be moved, or something else if m could not be.
+func (p *Planner) Plan(m Media) Result {
+	r := Result{Media: m, Content: m.Content(p.root)}
+	if p.taken[r.Content] {
+		r.Err = Dup{r.Content}
+		r.Removed = p.Take && m.Sidecar == ""
+		return r
+	}
+	if exists(r.Content) {
+		r.Err = Dup{r.Content}
+		if p.Take && m.Sidecar == "" {
+			linked, err := m.dupOf(r.Content)
+			if err != nil {
+				r.Err = err
+				return r
+			}
+			r.Removed = !linked
+		}
+		return r
+	}
+	date, err := m.date(p.root, func(name string) bool {
+		return p.taken[name] || exists(name)
+	})
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	p.taken[r.Content] = true
+	p.taken[date] = true
+	r.Date = date
+	if m.Sidecar != "" {
+		r.Sidecar = m.sidecarDate(date)
+	}
+	return r
+}
@@ -0,0 +1,158 @@
+package arrange
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	tiffLE = "II*\x00"
+	tiffBE = "MM\x00*"
+)
+
+// rawExifLimit is how much of a RAW file is handed to the EXIF decoder, which
+// keeps all it is given in memory, twice. IFD0 and the EXIF IFD come well
+// before the image data, which is left for the hash.
+const rawExifLimit = 4 << 20
+
+const (
+	tagMake       = 0x010f
+	tagDNGVersion = 0xc612
+)
+
+// rawParser handles one TIFF-based camera RAW format.
+type rawParser struct {
+	ext string
+}
+
+func (p rawParser) Extensions() []string { return []string{p.ext} }
+
+func (p rawParser) Sniff(hdr []byte) bool {
+	if len(hdr) < 16 {
+		return false
+	}
+	magic := string(hdr[:4])
+	switch p.ext {
+	case ".cr2":
+		return magic == tiffLE && string(hdr[8:10]) == "CR" && hdr[10] == 2
+	case ".orf":
+		return magic == "IIRO" || magic == "IIRS" || magic == "MMOR"
+	case ".rw2":
+		return magic == "IIU\x00"
+	case ".dng":
+		_, ok := ifd0Tag(hdr, tagDNGVersion)
+		return ok
+	case ".nef":
+		return strings.HasPrefix(tiffMake(hdr), "NIKON")
+	case ".arw":
+		return strings.HasPrefix(tiffMake(hdr), "SONY")
+	}
+	return false
+}
+
+func (p rawParser) Time(r io.ReadSeeker) (time.Time, error) {
+	c, err := parseRaw(r, p.ext)
+	return c.time, err
+}
+
+func (p rawParser) captured(r io.ReadSeeker) (capture, error) { return parseRaw(r, p.ext) }
+
+// ifd0Tag returns the 12 byte IFD0 entry for tag id if it can be found within
+// hdr, the start of a TIFF file.
+func ifd0Tag(hdr []byte, id uint16) ([]byte, bool) {
+	var order binary.ByteOrder
+	switch string(hdr[:4]) {
+	case tiffLE:
+		order = binary.LittleEndian
+	case tiffBE:
+		order = binary.BigEndian
+	default:
+		return nil, false
+	}
+	off := int(order.Uint32(hdr[4:8]))
+	if off+2 > len(hdr) {
+		return nil, false
+	}
+	n := int(order.Uint16(hdr[off : off+2]))
+	for i := 0; i < n; i++ {
+		e := off + 2 + 12*i
+		if e+12 > len(hdr) {
+			break
+		}
+		if order.Uint16(hdr[e:e+2]) == id {
+			return hdr[e : e+12], true
+		}
+	}
+	return nil, false
+}
+
+// tiffMake returns the camera maker recorded in IFD0, if it can be found
+// within hdr.
+func tiffMake(hdr []byte) string {
+	e, ok := ifd0Tag(hdr, tagMake)
+	if !ok {
+		return ""
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if string(hdr[:4]) == tiffBE {
+		order = binary.BigEndian
+	}
+	count := int(order.Uint32(e[4:8]))
+	var val []byte
+	if count <= 4 {
+		val = e[8 : 8+count]
+	} else {
+		off := int(order.Uint32(e[8:12]))
+		if off+count > len(hdr) {
+			return ""
+		}
+		val = hdr[off : off+count]
+	}
+	return strings.ToUpper(string(bytes.TrimRight(val, "\x00 ")))
+}
+
+// parseRaw validates the header of a TIFF-based camera RAW file and extracts
+// its EXIF time. It returns ErrFormat if the header does not match what ext
+// promises.
+func parseRaw(r io.Reader, ext string) (capture, error) {
+	ti := capture{}
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return ti, ErrFormat
+	}
+	magic := string(hdr[:4])
+
+	switch ext {
+	case ".cr2":
+		if magic != tiffLE || string(hdr[8:10]) != "CR" || hdr[10] != 2 {
+			return ti, ErrFormat
+		}
+	case ".nef", ".arw", ".dng":
+		if magic != tiffLE && magic != tiffBE {
+			return ti, ErrFormat
+		}
+	case ".orf":
+		// Olympus replaces the TIFF magic number with its own.
+		switch magic {
+		case "IIRO", "IIRS":
+			copy(hdr, tiffLE)
+		case "MMOR":
+			copy(hdr, tiffBE)
+		default:
+			return ti, ErrFormat
+		}
+	case ".rw2":
+		// as does Panasonic
+		if magic != "IIU\x00" {
+			return ti, ErrFormat
+		}
+		copy(hdr, tiffLE)
+	default:
+		return ti, ErrFormat
+	}
+
+	return parseExif(io.MultiReader(bytes.NewReader(hdr), io.LimitReader(r, rawExifLimit-int64(len(hdr)))))
+}
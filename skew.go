@@ -0,0 +1,174 @@
+package arrange
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// camera identifies the device a file came from, as its metadata tells it.
+type camera struct {
+	make   string
+	model  string
+	serial string
+}
+
+// Skew corrects the clock of a camera that was set wrong. A file's time is
+// corrected by the first of Skews that matches it.
+type Skew struct {
+	// Make, Model and Serial select the camera by its EXIF Make, Model and
+	// BodySerialNumber. Make and Model ignore case. Empty fields match any
+	// camera, but at least one must be given.
+	Make   string
+	Model  string
+	Serial string
+
+	// From and To, if set, limit the rule to files whose uncorrected times
+	// fall in [From, To).
+	From time.Time
+	To   time.Time
+
+	// Years, Months and Days are added to matching times, and then Offset.
+	// In a rules file Offset is written like "-1h30m".
+	Years  int
+	Months int
+	Days   int
+	Offset time.Duration
+}
+
+// Skews are the clock corrections ParseFile applies.
+var Skews []Skew
+
+// skewJSON is how a Skew is written in a rules file.
+type skewJSON struct {
+	Make   string    `json:"make,omitempty"`
+	Model  string    `json:"model,omitempty"`
+	Serial string    `json:"serial,omitempty"`
+	From   time.Time `json:"from,omitempty"`
+	To     time.Time `json:"to,omitempty"`
+	Years  int       `json:"years,omitempty"`
+	Months int       `json:"months,omitempty"`
+	Days   int       `json:"days,omitempty"`
+	Offset string    `json:"offset,omitempty"`
+}
+
+// UnmarshalJSON reads Offset as a time.Duration string.
+func (s *Skew) UnmarshalJSON(b []byte) error {
+	var j skewJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*s = Skew{
+		Make:   j.Make,
+		Model:  j.Model,
+		Serial: j.Serial,
+		From:   j.From,
+		To:     j.To,
+		Years:  j.Years,
+		Months: j.Months,
+		Days:   j.Days,
+	}
+	if j.Offset != "" {
+		d, err := time.ParseDuration(j.Offset)
+		if err != nil {
+			return fmt.Errorf("bad offset: %v", err)
+		}
+		s.Offset = d
+	}
+	return nil
+}
+
+// MarshalJSON writes Offset as a time.Duration string.
+func (s Skew) MarshalJSON() ([]byte, error) {
+	j := skewJSON{
+		Make:   s.Make,
+		Model:  s.Model,
+		Serial: s.Serial,
+		From:   s.From,
+		To:     s.To,
+		Years:  s.Years,
+		Months: s.Months,
+		Days:   s.Days,
+	}
+	if s.Offset != 0 {
+		j.Offset = s.Offset.String()
+	}
+	return json.Marshal(j)
+}
+
+// LoadSkews reads a rules file, a JSON array of Skews.
+func LoadSkews(path string) ([]Skew, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading skew rules: %v", err)
+	}
+	var skews []Skew
+	if err := json.Unmarshal(b, &skews); err != nil {
+		return nil, fmt.Errorf("problem parsing skew rules %q: %v", path, err)
+	}
+	for i, s := range skews {
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("skew rule %d in %q: %v", i, path, err)
+		}
+	}
+	return skews, nil
+}
+
+// check makes sure s selects some camera, and corrects its times.
+func (s Skew) check() error {
+	if s.Make == "" && s.Model == "" && s.Serial == "" {
+		return fmt.Errorf("no make, model or serial")
+	}
+	if !s.From.IsZero() && !s.To.IsZero() && !s.From.Before(s.To) {
+		return fmt.Errorf("from %v is not before to %v", s.From, s.To)
+	}
+	if s.Years == 0 && s.Months == 0 && s.Days == 0 && s.Offset == 0 {
+		return fmt.Errorf("no correction")
+	}
+	return nil
+}
+
+// matches reports whether s applies to a file from c taken at t.
+func (s Skew) matches(c camera, t time.Time) bool {
+	if s.Make != "" && !strings.EqualFold(s.Make, c.make) {
+		return false
+	}
+	if s.Model != "" && !strings.EqualFold(s.Model, c.model) {
+		return false
+	}
+	if s.Serial != "" && s.Serial != c.serial {
+		return false
+	}
+	if !s.From.IsZero() && t.Before(s.From) {
+		return false
+	}
+	if !s.To.IsZero() && !t.Before(s.To) {
+		return false
+	}
+	return true
+}
+
+// correct returns t as corrected by the first of Skews that matches c.
+func correct(c camera, t time.Time) time.Time {
+	for _, s := range Skews {
+		if s.matches(c, t) {
+			return t.AddDate(s.Years, s.Months, s.Days).Add(s.Offset)
+		}
+	}
+	return t
+}
+
+// skewDigest summarizes Skews for settings.
+func skewDigest() string {
+	if len(Skews) == 0 {
+		return "none"
+	}
+	b, err := json.Marshal(Skews)
+	if err != nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%x", sha1.Sum(b))
+}
@@ -0,0 +1,47 @@
+package arrange
+
+import (
+	"io"
+)
+
+// Sniff makes Source consider every file regardless of name, and ParseFile
+// pick a Parser by reading magic bytes rather than trusting the extension.
+var Sniff = false
+
+// sniffLen is how much of a file is read to detect its format.
+const sniffLen = 512
+
+// header returns the first sniffLen bytes of r, which is left positioned at
+// its start.
+func header(r io.ReadSeeker) ([]byte, error) {
+	hdr := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return hdr[:n], nil
+}
+
+// isHEIF reports whether hdr starts with an ftyp box naming a HEIF brand.
+func isHEIF(hdr []byte) bool {
+	if len(hdr) < 12 || string(hdr[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(hdr[0])<<24 | int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+	if size > len(hdr) {
+		size = len(hdr)
+	}
+	for i := 8; i+4 <= size; i += 4 {
+		// skip minor_version
+		if i == 12 {
+			continue
+		}
+		if heifBrands[string(hdr[i:i+4])] {
+			return true
+		}
+	}
+	return false
+}
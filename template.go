@@ -0,0 +1,155 @@
+package arrange
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// DefaultTemplate lays the date tree out as YYYY/MM/<unix nanoseconds><ext>.
+const DefaultTemplate = "{{.Year}}/{{.Month}}/{{.UnixNano}}{{.Ext}}"
+
+// DateTemplate is a text/template that names a Media's entry in the date
+// tree, relative to date/, with / between directories. It can use the Media's
+// {{.Time}} and {{.Hash}}, and Year, Month and Day (zero-padded), MonthName,
+// UnixNano and Ext. The short function abbreviates a hash.
+//
+// If the name is taken, _0000, _0001 and so on are tried before the
+// extension.
+var DateTemplate = DefaultTemplate
+
+// CaptureZone lays out each Media by the time of day where it was captured,
+// as far as that is known; see Media.Zone.
+const CaptureZone = "capture"
+
+// DateZone is the zone in which DateTemplate sees a Media's Time: CaptureZone,
+// or any name that time.LoadLocation accepts, such as "UTC", "Local" or
+// "Europe/Paris".
+var DateZone = CaptureZone
+
+var templateFuncs = template.FuncMap{
+	"short": func(hash string) string {
+		if len(hash) > 8 {
+			return hash[:8]
+		}
+		return hash
+	},
+}
+
+// templates holds parsed DateTemplates.
+var templates = struct {
+	sync.Mutex
+	parsed map[string]*template.Template
+}{
+	parsed: map[string]*template.Template{},
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	templates.Lock()
+	defer templates.Unlock()
+	if t, ok := templates.parsed[text]; ok {
+		return t, nil
+	}
+	t, err := template.New("date").Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("bad date template: %v", err)
+	}
+	templates.parsed[text] = t
+	return t, nil
+}
+
+// zones holds loaded DateZones.
+var zones = struct {
+	sync.Mutex
+	loaded map[string]*time.Location
+}{
+	loaded: map[string]*time.Location{},
+}
+
+// loadZone returns the location named by zone, or nil for CaptureZone.
+func loadZone(zone string) (*time.Location, error) {
+	if zone == CaptureZone {
+		return nil, nil
+	}
+	if zone == "" {
+		return nil, fmt.Errorf("empty date zone")
+	}
+	zones.Lock()
+	defer zones.Unlock()
+	if loc, ok := zones.loaded[zone]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, fmt.Errorf("bad date zone: %v", err)
+	}
+	zones.loaded[zone] = loc
+	return loc, nil
+}
+
+// dateFields is what DateTemplate is executed with. It only has what names a
+// file the same way wherever it was found, so its entry can be found again.
+type dateFields struct {
+	Time      time.Time
+	Hash      string
+	Year      string
+	Month     string
+	Day       string
+	MonthName string
+	UnixNano  int64
+	Ext       string
+}
+
+// datePath returns m's name under date/ according to the template text, with
+// m's Time seen in zone.
+func (m Media) datePath(text, zone string) (string, error) {
+	t, err := parseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	loc, err := loadZone(zone)
+	if err != nil {
+		return "", err
+	}
+	if loc != nil {
+		m.Time = m.Time.In(loc)
+	}
+	fields := dateFields{
+		Time:      m.Time,
+		Hash:      m.Hash,
+		Year:      fmt.Sprintf("%04d", m.Time.Year()),
+		Month:     fmt.Sprintf("%02d", m.Time.Month()),
+		Day:       fmt.Sprintf("%02d", m.Time.Day()),
+		MonthName: m.Time.Month().String(),
+		UnixNano:  m.Time.UnixNano(),
+		Ext:       m.Extension,
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, fields); err != nil {
+		return "", fmt.Errorf("problem executing date template: %v", err)
+	}
+	rel := filepath.Clean(filepath.FromSlash(buf.String()))
+	if rel == "." || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("date template gave %q, which is not inside date/", buf.String())
+	}
+	return rel, nil
+}
+
+// checkTemplate makes sure that text can name a typical Media, and keeps its
+// extension, by which Source finds it again.
+func checkTemplate(text string) error {
+	for _, ext := range []string{".jpg", ".mov", ".cr2"} {
+		rel, err := Media{Hash: strings.Repeat("0", 32), Extension: ext}.datePath(text, CaptureZone)
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(rel, ext) {
+			return fmt.Errorf("date template gave %q, which doesn't end in the extension", rel)
+		}
+	}
+	return nil
+}
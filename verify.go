@@ -0,0 +1,69 @@
+package arrange
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// address returns the hash that the file at path in root's content store is
+// named for, if it is named for one. The prefix directory is the first part
+// of that name, so a blob moved under the wrong one is named for a different
+// hash; only hashing it, as VerifyFile does, can tell.
+func address(path, root string) (string, bool) {
+	rel, err := filepath.Rel(filepath.Join(root, "content"), path)
+	if err != nil {
+		return "", false
+	}
+	dir, file := filepath.Dir(rel), filepath.Base(rel)
+	sum := dir + strings.TrimSuffix(file, filepath.Ext(file))
+	if len(dir) != 2 || len(sum) != hashLen(HashAlgorithm) {
+		return "", false
+	}
+	for _, c := range sum {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return "", false
+		}
+	}
+	return sum, true
+}
+
+// VerifyFile checks that the file at path in root's content store still
+// hashes to its address. It returns a BadAddress, Corrupt or Truncated error
+// if not.
+func VerifyFile(path, root string) error {
+	want, ok := address(path, root)
+	if !ok {
+		return BadAddress{path}
+	}
+	sum, err := HashFile(path)
+	if err != nil {
+		return err
+	}
+	if sum == want {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return Truncated{Path: path, Want: -1}
+	}
+	return Corrupt{Path: path, Hash: sum}
+}
+
+// Verify calls VerifyFile on each blob on input chan, and sends the result,
+// nil or not, down output chan.
+//
+// Exists so that it can be called many times concurrently.
+func Verify(in <-chan string, root string) <-chan error {
+	out := make(chan error)
+	go func() {
+		for path := range in {
+			out <- VerifyFile(path, root)
+		}
+		close(out)
+	}()
+	return out
+}
@@ -0,0 +1,308 @@
+package arrange
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// epoch1904 is the start of time for QuickTime and MP4 timestamps, in unix
+// seconds.
+const epoch1904 = -2082844800
+
+const appleCreationDate = "com.apple.quicktime.creationdate"
+
+var iditLayouts = []string{
+	"Mon Jan _2 15:04:05 2006",
+	"2006:01:02 15:04:05",
+	"2006/01/02 15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+var qtTimeLayouts = []string{
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05Z07:00",
+}
+
+// qtNaiveLayout is a creation date with no offset.
+const qtNaiveLayout = "2006-01-02T15:04:05"
+
+type quickTimeParser struct{}
+
+func (quickTimeParser) Extensions() []string { return []string{".mov", ".mp4", ".m4v"} }
+
+func (quickTimeParser) Sniff(hdr []byte) bool {
+	if len(hdr) < 12 {
+		return false
+	}
+	switch string(hdr[4:8]) {
+	case "ftyp":
+		return !isHEIF(hdr)
+	case "moov", "mdat", "wide":
+		// old QuickTime files have no ftyp
+		return true
+	}
+	return false
+}
+
+func (quickTimeParser) name(hdr []byte) string {
+	if string(hdr[4:8]) != "ftyp" {
+		return ".mov"
+	}
+	switch string(hdr[8:12]) {
+	case "qt  ":
+		return ".mov"
+	case "M4V ":
+		return ".m4v"
+	}
+	return ".mp4"
+}
+
+func (quickTimeParser) Time(r io.ReadSeeker) (time.Time, error) {
+	c, err := parseQuickTime(r)
+	return c.time, err
+}
+
+func (quickTimeParser) captured(r io.ReadSeeker) (capture, error) { return parseQuickTime(r) }
+
+type aviParser struct{}
+
+func (aviParser) Extensions() []string { return []string{".avi"} }
+
+func (aviParser) Sniff(hdr []byte) bool {
+	return len(hdr) >= 12 && string(hdr[:4]) == "RIFF" && string(hdr[8:12]) == "AVI "
+}
+
+func (aviParser) Time(r io.ReadSeeker) (time.Time, error) {
+	c, err := parseAVI(r)
+	return c.time, err
+}
+
+func (aviParser) captured(r io.ReadSeeker) (capture, error) { return parseAVI(r) }
+
+// parseQuickTime extracts the capture time from a QuickTime or MP4 container.
+//
+// Apple's com.apple.quicktime.creationdate is preferred because it is written
+// at capture time in the camera's zone; the movie header's creation_time is
+// used otherwise.
+func parseQuickTime(r io.ReadSeeker) (capture, error) {
+	ti := capture{}
+	f, err := whole(r)
+	if err != nil {
+		return ti, err
+	}
+	moov, err := child(r, f, 0, "moov")
+	if err != nil {
+		return ti, fmt.Errorf("no moov atom: %v", err)
+	}
+
+	if c, err := qtCreationDate(r, moov); err == nil {
+		return c, nil
+	}
+
+	mvhd, err := child(r, moov, 0, "mvhd")
+	if err != nil {
+		return ti, fmt.Errorf("no mvhd atom: %v", err)
+	}
+	buf, err := payload(r, mvhd)
+	if err != nil {
+		return ti, err
+	}
+	var secs uint64
+	switch {
+	case len(buf) >= 12 && buf[0] == 1:
+		secs = binary.BigEndian.Uint64(buf[4:12])
+	case len(buf) >= 8 && buf[0] == 0:
+		secs = uint64(binary.BigEndian.Uint32(buf[4:8]))
+	default:
+		return ti, fmt.Errorf("unsupported mvhd atom (%d bytes, version %d)", len(buf), buf[0])
+	}
+	if secs == 0 {
+		return ti, errors.New("mvhd creation_time unset")
+	}
+	return capture{
+		time:   time.Unix(int64(secs)+epoch1904, 0).UTC(),
+		source: TimeContainer,
+		zone:   ZoneUTC,
+	}, nil
+}
+
+// qtCreationDate looks for Apple's creation date in the moov/meta keys and
+// ilst atoms. Dates written without an offset are read as local time.
+func qtCreationDate(r io.ReadSeeker, moov box) (capture, error) {
+	ti := capture{}
+	meta, err := child(r, moov, 0, "meta")
+	if err != nil {
+		return ti, err
+	}
+	// QuickTime's meta atom is a plain atom, but MP4's is a full box with
+	// four bytes of version and flags before its children.
+	var skip int64
+	if _, err := child(r, meta, 0, "hdlr"); err != nil {
+		skip = 4
+	}
+	keys, err := child(r, meta, skip, "keys")
+	if err != nil {
+		return ti, err
+	}
+	ilst, err := child(r, meta, skip, "ilst")
+	if err != nil {
+		return ti, err
+	}
+
+	buf, err := payload(r, keys)
+	if err != nil {
+		return ti, err
+	}
+	if len(buf) < 8 {
+		return ti, errors.New("short keys atom")
+	}
+	count := binary.BigEndian.Uint32(buf[4:8])
+	index := uint32(0)
+	for i, off := uint32(1), 8; i <= count && off+8 <= len(buf); i++ {
+		size := int(binary.BigEndian.Uint32(buf[off : off+4]))
+		if size < 8 || off+size > len(buf) {
+			return ti, errors.New("malformed keys atom")
+		}
+		if string(buf[off+8:off+size]) == appleCreationDate {
+			index = i
+			break
+		}
+		off += size
+	}
+	if index == 0 {
+		return ti, errNoBox
+	}
+
+	items, err := boxes(r, ilst.start, ilst.end)
+	if err != nil {
+		return ti, err
+	}
+	for _, item := range items {
+		if binary.BigEndian.Uint32([]byte(item.typ)) != index {
+			continue
+		}
+		data, err := child(r, item, 0, "data")
+		if err != nil {
+			return ti, err
+		}
+		buf, err := payload(r, data)
+		if err != nil {
+			return ti, err
+		}
+		if len(buf) < 8 {
+			return ti, errors.New("short data atom")
+		}
+		s := strings.TrimRight(string(buf[8:]), "\x00")
+		for _, layout := range qtTimeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return capture{time: t, source: TimeContainer, zone: ZoneOffset}, nil
+			}
+		}
+		if t, err := time.ParseInLocation(qtNaiveLayout, s, time.Local); err == nil {
+			return capture{time: t, source: TimeContainer, zone: ZoneLocal}, nil
+		}
+		return ti, fmt.Errorf("unparseable creation date %q", s)
+	}
+	return ti, errNoBox
+}
+
+// parseAVI validates the RIFF header of an AVI file and extracts its capture
+// time, and where it came from, from either an IDIT chunk or EXIF data
+// embedded in a strd chunk. It returns ErrFormat if r is not an AVI file.
+func parseAVI(r io.ReadSeeker) (capture, error) {
+	ti := capture{}
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return ti, ErrFormat
+	}
+	if string(hdr[0:4]) != "RIFF" || string(hdr[8:12]) != "AVI " {
+		return ti, ErrFormat
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return ti, err
+	}
+	if size := int64(binary.LittleEndian.Uint32(hdr[4:8])) + 8; size < end {
+		end = size
+	}
+	return riffTime(r, 12, end)
+}
+
+// riffTime walks the RIFF chunks between start and end looking for a capture
+// time.
+func riffTime(r io.ReadSeeker, start, end int64) (capture, error) {
+	ti := capture{}
+	hdr := make([]byte, 12)
+	for off := start; off+8 <= end; {
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			return ti, err
+		}
+		if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+			return ti, err
+		}
+		id := string(hdr[:4])
+		size := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		if off+8+size > end {
+			return ti, fmt.Errorf("malformed %q chunk at offset %d", id, off)
+		}
+
+		switch id {
+		case "LIST":
+			if _, err := io.ReadFull(r, hdr[8:12]); err != nil {
+				return ti, err
+			}
+			// movi holds the frames themselves.
+			if string(hdr[8:12]) != "movi" {
+				if c, err := riffTime(r, off+12, off+8+size); err == nil {
+					return c, nil
+				}
+			}
+		case "IDIT":
+			buf, err := chunkData(r, id, size)
+			if err != nil {
+				return ti, err
+			}
+			s := strings.TrimSpace(strings.TrimRight(string(buf), "\x00"))
+			for _, layout := range iditLayouts {
+				if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+					return capture{time: t, source: TimeContainer, zone: ZoneLocal}, nil
+				}
+			}
+			return ti, fmt.Errorf("unparseable IDIT date %q", s)
+		case "strd":
+			buf, err := chunkData(r, id, size)
+			if err != nil {
+				return ti, err
+			}
+			for _, magic := range []string{"II*\x00", "MM\x00*"} {
+				if i := bytes.Index(buf, []byte(magic)); i >= 0 {
+					if c, err := parseExif(bytes.NewReader(buf[i:])); err == nil {
+						return c, nil
+					}
+				}
+			}
+		}
+
+		// chunks are padded to an even length
+		off += 8 + size + size%2
+	}
+	return ti, errors.New("no capture time in riff chunks")
+}
+
+// chunkData reads the size byte payload of the RIFF chunk id at the current
+// offset of r.
+func chunkData(r io.Reader, id string, size int64) ([]byte, error) {
+	if size > 1<<20 {
+		return nil, fmt.Errorf("%q chunk too large to read: %d bytes", id, size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,357 @@
+package arrange
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XMP namespaces that hold dates and ratings.
+const (
+	nsXMP       = "http://ns.adobe.com/xap/1.0/"
+	nsPhotoshop = "http://ns.adobe.com/photoshop/1.0/"
+)
+
+// xmpHeader starts a JPEG APP1 segment that holds an XMP packet.
+const xmpHeader = nsXMP + "\x00"
+
+// pngXMPKeyword names the PNG iTXt chunk that holds an XMP packet.
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+// sidecarExt is the extension of XMP sidecar files.
+const sidecarExt = ".xmp"
+
+// maxXMP bounds the size of XMP packets that are read.
+const maxXMP = 16 << 20
+
+// xmpLayouts are the XMP date forms precise enough to be worth using. XMP
+// also allows a bare year, or year and month.
+var xmpLayouts = []struct {
+	layout string
+	zoned  bool
+}{
+	{"2006-01-02T15:04:05Z07:00", true},
+	{"2006-01-02T15:04Z07:00", true},
+	{"2006-01-02T15:04:05", false},
+	{"2006-01-02T15:04", false},
+	{"2006-01-02", false},
+}
+
+// parseXMP returns the time (xmp:CreateDate, or else photoshop:DateCreated)
+// and rating in the XMP packet b. The time is zero if b has neither date. It
+// returns false if b holds nothing of use.
+func parseXMP(b []byte) (capture, bool) {
+	c := capture{source: TimeXMP}
+	vals := map[xml.Name]string{}
+	want := map[xml.Name]bool{
+		{Space: nsXMP, Local: "CreateDate"}:        true,
+		{Space: nsPhotoshop, Local: "DateCreated"}: true,
+		{Space: nsXMP, Local: "Rating"}:            true,
+	}
+	record := func(n xml.Name, v string) {
+		if v = strings.TrimSpace(v); want[n] && v != "" && vals[n] == "" {
+			vals[n] = v
+		}
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(b))
+	var cur xml.Name
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			for _, a := range t.Attr {
+				record(a.Name, a.Value)
+			}
+			cur = t.Name
+		case xml.CharData:
+			record(cur, string(t))
+		case xml.EndElement:
+			cur = xml.Name{}
+		}
+	}
+
+	if r, err := strconv.ParseFloat(vals[xml.Name{Space: nsXMP, Local: "Rating"}], 64); err == nil {
+		c.rating = int(math.Round(r))
+	}
+	for _, n := range []xml.Name{{Space: nsXMP, Local: "CreateDate"}, {Space: nsPhotoshop, Local: "DateCreated"}} {
+		s := vals[n]
+		if s == "" {
+			continue
+		}
+		for _, l := range xmpLayouts {
+			if l.zoned {
+				if t, err := time.Parse(l.layout, s); err == nil {
+					c.time, c.zone = t, ZoneOffset
+					break
+				}
+			} else if t, err := time.ParseInLocation(l.layout, s, time.Local); err == nil {
+				c.time, c.zone = t, ZoneLocal
+				break
+			}
+		}
+		if !c.time.IsZero() {
+			break
+		}
+	}
+	return c, !c.time.IsZero() || c.rating != 0
+}
+
+// withXMP adds what the XMP packet says to c, which came with err. Its time
+// replaces c's if TimePrecedence prefers it, or c has none, or c's came from
+// XMP too. Its rating, if it has one, replaces c's.
+//
+// A file's own packet is added before its sidecar's, so the sidecar wins
+// where they disagree, as it does in Lightroom and darktable: it is where
+// later edits go.
+func withXMP(c capture, err error, packet []byte) (capture, error) {
+	if err == ErrFormat || packet == nil {
+		return c, err
+	}
+	x, ok := parseXMP(packet)
+	if !ok {
+		return c, err
+	}
+	if x.rating != 0 {
+		c.rating = x.rating
+	}
+	if x.time.IsZero() || rank(TimeXMP) < 0 {
+		return c, err
+	}
+	if err != nil || c.time.IsZero() || rank(c.source) < 0 || rank(TimeXMP) <= rank(c.source) {
+		c.time, c.source, c.zone = x.time, TimeXMP, x.zone
+		err = nil
+	}
+	return c, err
+}
+
+// jpegXMP returns the XMP packet in the JPEG r, or nil.
+func jpegXMP(r io.ReadSeeker) []byte {
+	if _, err := r.Seek(2, io.SeekStart); err != nil {
+		return nil
+	}
+	hdr := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, hdr[:2]); err != nil || hdr[0] != 0xff {
+			return nil
+		}
+		marker := hdr[1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			if _, err := r.Seek(-1, io.SeekCurrent); err != nil {
+				return nil
+			}
+			continue
+		case marker == 0xd9 || marker == 0xda:
+			// the image itself, after which there are no more segments
+			return nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			continue
+		}
+		if _, err := io.ReadFull(r, hdr[2:4]); err != nil {
+			return nil
+		}
+		size := int64(binary.BigEndian.Uint16(hdr[2:4])) - 2
+		if size < 0 {
+			return nil
+		}
+		if marker == 0xe1 && size > int64(len(xmpHeader)) {
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil
+			}
+			if bytes.HasPrefix(buf, []byte(xmpHeader)) {
+				return buf[len(xmpHeader):]
+			}
+			continue
+		}
+		if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+			return nil
+		}
+	}
+}
+
+// pngXMP returns the XMP packet in the iTXt chunk of the PNG r, or nil.
+func pngXMP(r io.ReadSeeker) []byte {
+	if _, err := r.Seek(8, io.SeekStart); err != nil {
+		return nil
+	}
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch string(hdr[4:8]) {
+		case "IEND":
+			return nil
+		case "iTXt":
+			if size <= maxXMP {
+				buf := make([]byte, size)
+				if _, err := io.ReadFull(r, buf); err != nil {
+					return nil
+				}
+				if text, ok := pngXMPText(buf); ok {
+					return text
+				}
+				size = 0
+			}
+		}
+		// skip the data, and the CRC after it
+		if _, err := r.Seek(size+4, io.SeekCurrent); err != nil {
+			return nil
+		}
+	}
+}
+
+// pngXMPText returns the text of the iTXt chunk data buf, if it is XMP.
+func pngXMPText(buf []byte) ([]byte, bool) {
+	// keyword, compression flag and method, language and translated keyword
+	parts := bytes.SplitN(buf, []byte{0}, 2)
+	if len(parts) != 2 || string(parts[0]) != pngXMPKeyword || len(parts[1]) < 2 {
+		return nil, false
+	}
+	compressed := parts[1][0] == 1
+	rest := bytes.SplitN(parts[1][2:], []byte{0}, 3)
+	if len(rest) != 3 {
+		return nil, false
+	}
+	text := rest[2]
+	if !compressed {
+		return text, true
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(text))
+	if err != nil {
+		return nil, false
+	}
+	defer zr.Close()
+	text, err = ioutil.ReadAll(io.LimitReader(zr, maxXMP))
+	return text, err == nil
+}
+
+// isSidecar reports whether path names an XMP sidecar.
+func isSidecar(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), sidecarExt)
+}
+
+// findSidecar returns the path of the XMP sidecar for the file at path, named
+// either like IMG_1234.CR2.xmp or like IMG_1234.xmp, or "" if it has none.
+func findSidecar(path string) string {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, p := range []string{path, base} {
+		for _, ext := range []string{sidecarExt, strings.ToUpper(sidecarExt)} {
+			if fi, err := os.Stat(p + ext); err == nil && fi.Mode().IsRegular() {
+				return p + ext
+			}
+		}
+	}
+	return ""
+}
+
+// sidecarShared reports whether a file other than path, in the same
+// directory, also has the sidecar at sidecar.
+func sidecarShared(path, sidecar string) bool {
+	dir := filepath.Dir(sidecar)
+	d, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		// when in doubt, keep it
+		return true
+	}
+	base := strings.TrimSuffix(filepath.Base(sidecar), filepath.Ext(sidecar))
+	for _, n := range names {
+		p := filepath.Join(dir, n)
+		if p == path || isSidecar(n) || !strings.HasPrefix(strings.ToLower(n), strings.ToLower(base)+".") {
+			continue
+		}
+		if findSidecar(p) == sidecar {
+			return true
+		}
+	}
+	return false
+}
+
+// readSidecar returns the contents of the XMP sidecar at path, or nil.
+func readSidecar(path string) []byte {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, maxXMP))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// sidecarDate returns where m's sidecar goes beside date, m's entry in the
+// date tree, named in the same style as the original.
+func (m Media) sidecarDate(date string) string {
+	ext := filepath.Ext(m.Sidecar)
+	if strings.EqualFold(strings.TrimSuffix(filepath.Base(m.Sidecar), ext), filepath.Base(m.Path)) {
+		return date + ext
+	}
+	return strings.TrimSuffix(date, m.Extension) + ext
+}
+
+// copySidecar copies the sidecar at src to dst, unless dst already exists or
+// src has gone, and reports whether it did.
+func copySidecar(src, dst string) (bool, error) {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), tempPrefix)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(tmp, in)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = commit(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}